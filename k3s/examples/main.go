@@ -5,6 +5,8 @@ package main
 import (
 	"context"
 	"dagger/examples/internal/dagger"
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -73,3 +75,64 @@ func (m *Examples) K3SKubectl(ctx context.Context, args string) *dagger.Containe
 func (m *Examples) K3SKns(ctx context.Context) *dagger.Container {
 	return dag.K3S("test").Kns()
 }
+
+// starts a k3s server and installs a helm chart from an OCI registry
+func (m *Examples) K3SHelmOci(ctx context.Context) (string, error) {
+	k3s := dag.K3S("test")
+	if _, err := k3s.Server().Start(ctx); err != nil {
+		return "", err
+	}
+
+	return k3s.HelmInstall("nginx", "oci://registry-1.docker.io/bitnamicharts/nginx").
+		WithExec([]string{"helm", "status", "nginx"}).
+		Stdout(ctx)
+}
+
+// starts a k3s server whose container is customized with a Go function
+func (m *Examples) K3SCustomContainer(ctx context.Context) *dagger.Service {
+	withDebugEnv := func(c *dagger.Container) *dagger.Container {
+		return c.WithEnvVariable("K3S_DEBUG", "true")
+	}
+	return dag.K3S("test").With(func(k *dagger.K3S) *dagger.K3S {
+		return k.WithContainer(k.Container().With(withDebugEnv))
+	}).Server()
+}
+
+// times two consecutive starts of new clusters with and without the shared
+// image cache. Without it every cluster pulls the k3s system images again,
+// with it only the first one does.
+func (m *Examples) K3SShareImageCacheTiming(ctx context.Context) (string, error) {
+	var out strings.Builder
+	for _, share := range []bool{false, true} {
+		for i := 1; i <= 2; i++ {
+			k3s := dag.K3S(fmt.Sprintf("timing-%t-%d", share, i), dagger.K3SOpts{ShareImageCache: share})
+			start := time.Now()
+			if _, err := k3s.Start().Start(ctx); err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&out, "shareImageCache=%t start %d: %s\n", share, i, time.Since(start).Round(time.Second))
+			if err := k3s.Stop(ctx); err != nil {
+				return "", err
+			}
+		}
+	}
+	return out.String(), nil
+}
+
+// times repeated Config calls of one cluster instance: the first one waits
+// for the server to write the kubeconfig, the others reuse the cached result
+func (m *Examples) K3SConfigTiming(ctx context.Context) (string, error) {
+	k3s := dag.K3S("test")
+	if _, err := k3s.Server().Start(ctx); err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	for i := 1; i <= 3; i++ {
+		start := time.Now()
+		if _, err := k3s.Config().Contents(ctx); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&out, "config %d: %s\n", i, time.Since(start).Round(time.Millisecond))
+	}
+	return out.String(), nil
+}
@@ -4,8 +4,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"dagger/k-3-s/internal/dagger"
@@ -39,6 +45,78 @@ fi
 exec "$@"
 `
 
+// serverScript starts the k3s server bound to the container address (unless
+// overridden with BIND_ADDRESS), the flags are passed through as positional
+// arguments. Datastore credentials are kept in a secret and only spliced into
+// the endpoint here. Images to pre-pull are pulled once containerd is up, a
+// failed pull stops the server. The logs are kept in a cache volume for
+// AllLogs, and when the server exits its last logs are left in the config
+// cache so that Config can fail instead of waiting for a kubeconfig that never
+// shows up. The config cache is marked with the generation of the instance so
+// that Config ignores the kubeconfig of a previous run.
+const serverScript = `
+rm -f /etc/rancher/k3s/k3s.yaml /etc/rancher/k3s/server.exited /etc/rancher/k3s/prepull.done /etc/rancher/k3s/prepull.failed
+printf '%s' "$K3S_GENERATION" > /etc/rancher/k3s/generation
+if [ -n "${DATASTORE_CREDENTIALS:-}" ]; then
+  export K3S_DATASTORE_ENDPOINT="${K3S_DATASTORE_ENDPOINT%%://*}://${DATASTORE_CREDENTIALS}@${K3S_DATASTORE_ENDPOINT#*://}"
+fi
+: > /var/log/k3s/server.log
+k3s server --bind-address "${BIND_ADDRESS:-$(ip route | grep src | awk '{print $NF}')}" --log=/var/log/k3s/server.log --alsologtostderr "$@" &
+pid=$!
+if [ -n "${K3S_PREPULL_IMAGES:-}" ]; then
+  (
+    until k3s ctr version >/dev/null 2>&1; do sleep 1; done
+    for image in $K3S_PREPULL_IMAGES; do
+      if ! k3s ctr -n k8s.io images pull "$image" > /var/log/prepull.log 2>&1; then
+        { echo "pulling $image failed:"; cat /var/log/prepull.log; } > /etc/rancher/k3s/prepull.failed
+        kill -TERM "$pid"
+        exit 1
+      fi
+    done
+    touch /etc/rancher/k3s/prepull.done
+  ) &
+fi
+exited() {
+  {
+    cat /etc/rancher/k3s/prepull.failed 2>/dev/null
+    echo "k3s server exited with code $1, last logs:"
+    tail -n 50 /var/log/k3s/server.log
+  } > /etc/rancher/k3s/server.exited
+  exit "$1"
+}
+trap 'kill -TERM "$pid"; wait "$pid"; exited $?' TERM INT
+wait "$pid"
+exited $?
+`
+
+// dnsSubdomain matches RFC 1123 subdomains, as required for node names
+var dnsSubdomain = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// kubectlRetry wraps kubectl to retry invocations failing with transient API
+// server errors, such as the connection refused errors right after startup,
+// with an exponential backoff. Only the errors are buffered, the output is
+// streamed as usual. Commands reading from stdin can't be replayed.
+const kubectlRetry = `#!/bin/sh
+PATH=${PATH#/opt/k3s-retry:}
+errors=$(mktemp)
+trap 'rm -f "$errors"' EXIT
+attempt=0
+delay=1
+while :; do
+  kubectl "$@" 2>"$errors"
+  code=$?
+  if [ "$code" -eq 0 ] || [ "$attempt" -ge "$KUBECTL_RETRIES" ] ||
+    ! grep -qE 'connection refused|i/o timeout|TLS handshake timeout|ServiceUnavailable|unexpected EOF' "$errors"; then
+    cat "$errors" >&2
+    exit "$code"
+  fi
+  attempt=$((attempt + 1))
+  echo "kubectl failed with a transient error, retrying in ${delay}s ($attempt/$KUBECTL_RETRIES)" >&2
+  sleep "$delay"
+  [ "$delay" -lt 8 ] && delay=$((delay * 2))
+done
+`
+
 type K3S struct {
 	// +private
 	Name string
@@ -46,9 +124,45 @@ type K3S struct {
 	// +private
 	ConfigCache *dagger.CacheVolume
 
+	// +private
+	StateCache *dagger.CacheVolume
+
+	// +private
+	LogCache *dagger.CacheVolume
+
+	// +private
+	Image string
+
 	Container *dagger.Container
 
 	Port int
+
+	// identifies this instance of the cluster, the server regenerates its
+	// TLS certificates and kubeconfig for every instance
+	// +private
+	Generation string
+
+	// +private
+	ServerArgs []string
+
+	// +private
+	Rootless bool
+
+	// +private
+	FeatureGates []string
+
+	// +private
+	PrePulledImages []string
+
+	// kubectl context used by the kubectl and helm helpers, the kubeconfig's
+	// current context when empty
+	KubectlContext string
+
+	// +private
+	KubectlConfigs []*dagger.File
+
+	// +private
+	KubectlRetries int
 }
 
 func New(
@@ -61,6 +175,45 @@ func New(
 	// +optional
 	// +default="false"
 	keepState bool,
+
+	// disables the bundled traefik ingress controller
+	// +optional
+	// +default=true
+	disableTraefik bool,
+
+	// disables the bundled metrics-server. Keep it enabled for PodMetrics.
+	// +optional
+	// +default=true
+	disableMetricsServer bool,
+
+	// runs k3s rootless as an unprivileged user, without root capabilities.
+	// The image must provide rootlesskit's runtime requirements (slirp4netns,
+	// newuidmap and newgidmap, which the default image doesn't ship) and the
+	// engine must allow unprivileged user namespaces and cgroup v2 delegation.
+	// +optional
+	// +default=false
+	rootless bool,
+
+	// keeps the containerd image store in a cache volume shared by all
+	// clusters instead of the per-cluster state, so images (including the k3s
+	// system images) are pulled once instead of on every start of every
+	// cluster. The volume is used by one cluster at a time: a cluster started
+	// while another one uses it gets a new, empty volume and pulls everything
+	// again. The time saved on a warm start is the time the pulls take, which
+	// depends on the registry bandwidth; the K3SShareImageCacheTiming example
+	// measures it.
+	// +optional
+	// +default=false
+	shareImageCache bool,
+
+	// reruns the server container setup on every run, which regenerates the
+	// TLS certificates and, unless keepState is set, wipes the cluster state.
+	// Disabling it lets Dagger cache the setup so clusters start faster, but
+	// the certificates and the state of the previous run with the same name
+	// are then reused, as if keepState was set.
+	// +optional
+	// +default=true
+	cacheBust bool,
 ) *K3S {
 
 	port, err := getFreePort()
@@ -69,7 +222,12 @@ func New(
 	}
 	fmt.Printf("First available port: %d\n", port)
 
+	generation := time.Now().String()
+	// the kubeconfig and the cluster state are kept in cache volumes scoped
+	// to the cluster name, so clusters with different names never share them.
 	ccache := dag.CacheVolume("k3s_config_" + name)
+	scache := dag.CacheVolume("k3s_cache_" + name)
+	lcache := dag.CacheVolume("k3s_logs_" + name)
 	ctr := dag.Container().
 		From(image).
 		WithNewFile("/usr/bin/entrypoint.sh", entrypoint, dagger.ContainerWithNewFileOpts{
@@ -79,9 +237,19 @@ func New(
 		WithMountedCache("/etc/rancher/k3s", ccache).
 		WithMountedTemp("/etc/lib/cni").
 		WithMountedTemp("/var/lib/kubelet").
-		WithMountedCache("/var/lib/rancher", dag.CacheVolume("k3s_cache_"+name)).
-		WithEnvVariable("CACHEBUST", time.Now().String()).
-		WithExec([]string{"rm", "-rf", "/var/lib/rancher/k3s/server/tls", "/etc/rancher/k3s/k3s.yaml"}).
+		WithMountedCache("/var/lib/rancher", scache).
+		With(func(c *dagger.Container) *dagger.Container {
+			if cacheBust {
+				c = c.WithEnvVariable("CACHEBUST", generation)
+			}
+			return c
+		}).
+		// the files options write into the cache volumes are removed too, so
+		// they don't outlive a run with keepState.
+		WithExec([]string{"rm", "-rf", "/var/lib/rancher/k3s/server/tls", "/etc/rancher/k3s/k3s.yaml", "/etc/rancher/k3s/server.exited", "/etc/rancher/k3s/prepull.done",
+			"/var/lib/rancher/k3s/agent/etc/containerd/config.toml.tmpl", "/var/lib/rancher/k3s/agent/etc/containerd/config-v3.toml.tmpl",
+			"/etc/rancher/k3s/registries.yaml",
+		}).
 		With(func(c *dagger.Container) *dagger.Container {
 			if !keepState {
 				c = c.WithExec([]string{"rm", "-rf", "/var/lib/rancher/k3s/"})
@@ -89,30 +257,662 @@ func New(
 			}
 			return c
 		}).
+		With(func(c *dagger.Container) *dagger.Container {
+			if shareImageCache {
+				// mounted after the state cleanup, which would otherwise
+				// wipe it.
+				c = c.WithMountedCache("/var/lib/rancher/k3s/agent/containerd", dag.CacheVolume("k3s_containerd"), dagger.ContainerWithMountedCacheOpts{
+					Sharing: dagger.CacheSharingModePrivate,
+				})
+			}
+			return c
+		}).
 		WithMountedTemp("/var/log").
-		WithExposedPort(port)
+		WithMountedCache("/var/log/k3s", lcache).
+		WithExposedPort(port).
+		With(func(c *dagger.Container) *dagger.Container {
+			if rootless {
+				c = c.
+					// the user is only switched to in Server, so the
+					// options can still exec as root.
+					WithExec([]string{"sh", "-c", "adduser -D -u 1000 k3s && chown -R k3s /etc/rancher/k3s /var/lib/rancher /var/lib/kubelet /var/log"})
+			}
+			return c
+		})
+	var args []string
+	if rootless {
+		// keep the state and kubeconfig where the rest of the module
+		// expects them instead of the user's home directory.
+		args = append(args, "--rootless", "--data-dir=/var/lib/rancher/k3s", "--write-kubeconfig=/etc/rancher/k3s/k3s.yaml")
+	}
+	if disableTraefik {
+		args = append(args, "--disable", "traefik")
+	}
+	if disableMetricsServer {
+		args = append(args, "--disable", "metrics-server")
+	}
 	return &K3S{
 		Name:        name,
 		ConfigCache: ccache,
+		StateCache:  scache,
+		LogCache:    lcache,
+		Image:       image,
 		Container:   ctr,
 		Port:        port,
+		Generation:  generation,
+		ServerArgs:  args,
+		Rootless:    rootless,
 	}
 }
 
 // Returns a newly initialized kind cluster
 func (m *K3S) Server() *dagger.Service {
+	args := []string{
+		"--debug",
+		fmt.Sprintf("--https-listen-port=%d", m.Port),
+		"--egress-selector-mode=disabled",
+		// reports all the images in the node status for HasImage.
+		"--kubelet-arg=node-status-max-images=-1",
+	}
+	args = append(args, m.ServerArgs...)
+	if len(m.FeatureGates) > 0 {
+		gates := strings.Join(m.FeatureGates, ",")
+		args = append(args, "--kube-apiserver-arg=feature-gates="+gates, "--kubelet-arg=feature-gates="+gates)
+	}
 	return m.Container.
+		// lets Config tell this instance's kubeconfig from the previous
+		// one left in the config cache.
+		WithEnvVariable("K3S_GENERATION", m.Generation).
+		With(func(c *dagger.Container) *dagger.Container {
+			if m.Rootless {
+				c = c.WithUser("k3s")
+			}
+			return c
+		}).
 		AsService(dagger.ContainerAsServiceOpts{
-			Args: []string{
-				"sh", "-c",
-				fmt.Sprintf("k3s server --debug --https-listen-port=%d --bind-address $(ip route | grep src | awk '{print $NF}') --disable traefik --disable metrics-server --egress-selector-mode=disabled", m.Port),
-			},
-			InsecureRootCapabilities: true,
-			UseEntrypoint:            true,
+			Args: append([]string{"sh", "-c", serverScript, "k3s"}, args...),
+			// the cgroup entrypoint needs root, rootless k3s sets up its
+			// own cgroups through rootlesskit.
+			InsecureRootCapabilities: !m.Rootless,
+			UseEntrypoint:            !m.Rootless,
 		})
 }
 
-// Returns a newly initialized kind cluster
+// stops the server gracefully: k3s receives a SIGTERM and is waited on, so the
+// datastore is flushed before keepState reuses it on the next run
+func (m *K3S) Stop(ctx context.Context) error {
+	_, err := m.Server().Stop(ctx)
+	return err
+}
+
+// starts the server and waits until its node is Ready, failing when that
+// doesn't happen within the timeout instead of leaving a broken cluster
+// running silently
+func (m *K3S) Start(ctx context.Context,
+	// seconds to wait for the node to become Ready
+	// +optional
+	// +default=180
+	timeout int,
+) (*dagger.Service, error) {
+	end := time.Now().Add(time.Duration(timeout) * time.Second)
+	svc, err := m.Server().Start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the cluster's own kubeconfig, whatever context the helpers use. The
+	// timeout also bounds the wait for it, the server only writes it once
+	// it's up.
+	left := max(int(time.Until(end).Seconds()), 1)
+	config := m.Config(ctx, false, "", false, "", left, "")
+	res, err := m.scriptResultWithin(ctx, config, fmt.Sprintf(`
+end=%d
+until [ -n "$(kubectl get nodes -o name 2>/dev/null)" ]; do
+  [ "$(date +%%s)" -ge "$end" ] && echo "no node registered" >&2 && exit 1
+  sleep 1
+done
+left=$(( end - $(date +%%s) ))
+[ "$left" -lt 1 ] && left=1
+kubectl wait --for=condition=Ready nodes --all --timeout="${left}s" && exit 0
+kubectl describe nodes >&2
+exit 1
+`, end.Unix()))
+	if err != nil {
+		return nil, fmt.Errorf("node not ready within %ds: %w", timeout, err)
+	}
+	if res.ExitCode != 0 {
+		return nil, fmt.Errorf("node not ready within %ds: %s", timeout, strings.TrimSpace(res.Stderr))
+	}
+	return svc, nil
+}
+
+// enables SELinux support in the embedded containerd (--selinux).
+//
+// This only works on hosts running with SELinux enabled and the k3s-selinux
+// policy package installed, since the labels are enforced by the host kernel
+// and not by the k3s container.
+func (m *K3S) WithSelinux() *K3S {
+	m.ServerArgs = append(m.ServerArgs, "--selinux")
+	return m
+}
+
+// adds the given PEM encoded CA certificate to the trust store of the server
+// container, so that containerd trusts registries signed by it.
+//
+// The certificate is not propagated to the pods, workloads that need to trust
+// it have to mount it themselves (e.g. from a ConfigMap).
+func (m *K3S) WithTrustedCA(cert *dagger.File) *K3S {
+	m.Container = m.Container.
+		WithFile("/tmp/ca.crt", cert).
+		WithExec([]string{"sh", "-c", "cat /tmp/ca.crt >> /etc/ssl/certs/ca-certificates.crt"}).
+		WithoutFile("/tmp/ca.crt")
+	return m
+}
+
+// sets the kube-proxy mode, one of iptables, ipvs or nftables.
+//
+// The ipvs mode requires the ip_vs, ip_vs_rr, ip_vs_wrr, ip_vs_sh and
+// nf_conntrack kernel modules to be loaded on the host running the engine,
+// they can't be loaded from within the container.
+func (m *K3S) WithKubeProxyMode(mode string) (*K3S, error) {
+	switch mode {
+	case "iptables", "ipvs", "nftables":
+	default:
+		return nil, fmt.Errorf("unsupported kube-proxy mode %q", mode)
+	}
+	m.ServerArgs = append(m.ServerArgs, "--kube-proxy-arg=proxy-mode="+mode)
+	return m, nil
+}
+
+// sets the image used for the pod sandbox (pause) containers, allowing the
+// cluster to start without access to the default registry
+func (m *K3S) WithPauseImage(image string) *K3S {
+	m.ServerArgs = append(m.ServerArgs, "--pause-image="+image)
+	return m
+}
+
+// routes the outgoing traffic of the server, including image pulls made by the
+// embedded containerd, through the given proxy. k3s adds the cluster pod and
+// service CIDRs to NO_PROXY on its own.
+func (m *K3S) WithProxy(
+	httpProxy string,
+	// defaults to httpProxy
+	// +optional
+	httpsProxy string,
+	// +optional
+	noProxy string,
+) *K3S {
+	if httpsProxy == "" {
+		httpsProxy = httpProxy
+	}
+	m.Container = m.Container.
+		WithEnvVariable("HTTP_PROXY", httpProxy).
+		WithEnvVariable("HTTPS_PROXY", httpsProxy).
+		With(func(c *dagger.Container) *dagger.Container {
+			if noProxy != "" {
+				c = c.WithEnvVariable("NO_PROXY", noProxy)
+			}
+			return c
+		})
+	return m
+}
+
+// sets the k3s log verbosity (-v), higher levels are noisier. The logs are
+// plain text without ANSI colors already, since the server output is never
+// attached to a terminal.
+func (m *K3S) WithLogLevel(level int) (*K3S, error) {
+	if level < 0 {
+		return nil, fmt.Errorf("log level must not be negative, got %d", level)
+	}
+	m.ServerArgs = append(m.ServerArgs, "-v", strconv.Itoa(level))
+	return m, nil
+}
+
+// uses an external SQL datastore (e.g. postgres://db:5432/k3s or
+// mysql://tcp(db:3306)/k3s) instead of the embedded SQLite database
+func (m *K3S) WithDatastore(
+	endpoint string,
+	// user:password spliced into the endpoint at startup
+	// +optional
+	credentials *dagger.Secret,
+	// datastore service to bind to the server
+	// +optional
+	service *dagger.Service,
+	// hostname the datastore service is reachable at
+	// +optional
+	// +default="db"
+	alias string,
+) *K3S {
+	m.Container = m.Container.
+		WithEnvVariable("K3S_DATASTORE_ENDPOINT", endpoint).
+		With(func(c *dagger.Container) *dagger.Container {
+			if credentials != nil {
+				c = c.WithSecretVariable("DATASTORE_CREDENTIALS", credentials)
+			}
+			if service != nil {
+				c = c.WithServiceBinding(alias, service)
+			}
+			return c
+		})
+	return m
+}
+
+// configures TLS for the external datastore set with WithDatastore
+func (m *K3S) WithDatastoreTLS(
+	// CA certificate used to verify the datastore server
+	// +optional
+	ca *dagger.File,
+	// client certificate
+	// +optional
+	cert *dagger.File,
+	// client key
+	// +optional
+	key *dagger.Secret,
+) *K3S {
+	if ca != nil {
+		m.Container = m.Container.WithFile("/etc/k3s-datastore/ca.crt", ca)
+		m.ServerArgs = append(m.ServerArgs, "--datastore-cafile=/etc/k3s-datastore/ca.crt")
+	}
+	if cert != nil {
+		m.Container = m.Container.WithFile("/etc/k3s-datastore/client.crt", cert)
+		m.ServerArgs = append(m.ServerArgs, "--datastore-certfile=/etc/k3s-datastore/client.crt")
+	}
+	if key != nil {
+		m.Container = m.Container.WithMountedSecret("/etc/k3s-datastore/client.key", key)
+		m.ServerArgs = append(m.ServerArgs, "--datastore-keyfile=/etc/k3s-datastore/client.key")
+	}
+	return m
+}
+
+// taints the server node with node-role.kubernetes.io/control-plane:NoSchedule
+// so that only pods tolerating it are scheduled there.
+//
+// In a single-node cluster this leaves workloads without a matching toleration
+// Pending, the bundled k3s components already tolerate the taint.
+func (m *K3S) WithControlPlaneTaint() *K3S {
+	m.ServerArgs = append(m.ServerArgs, "--node-taint=node-role.kubernetes.io/control-plane:NoSchedule")
+	return m
+}
+
+// uses the given resolv.conf for the kubelet (--resolv-conf), which sets the
+// upstream nameservers of the pods and CoreDNS
+func (m *K3S) WithResolvConf(file *dagger.File) *K3S {
+	m.Container = m.Container.WithFile("/etc/k3s-resolv.conf", file)
+	if !slices.Contains(m.ServerArgs, "--resolv-conf=/etc/k3s-resolv.conf") {
+		m.ServerArgs = append(m.ServerArgs, "--resolv-conf=/etc/k3s-resolv.conf")
+	}
+	return m
+}
+
+// exposes an additional port of the server container, e.g. a NodePort, so it
+// can be reached through the service binding
+func (m *K3S) WithExposedPort(port int) *K3S {
+	m.Container = m.Container.WithExposedPort(port)
+	return m
+}
+
+// sets the number of layers containerd downloads in parallel per image pull
+// (max_concurrent_downloads, 3 by default).
+//
+// The setting is merged into the config generated by k3s through a containerd
+// config template importing it, for both containerd 1.x and 2.x based images.
+// The templates are removed again on the next run, whether or not it uses the
+// option.
+func (m *K3S) WithMaxConcurrentDownloads(n int) (*K3S, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("max concurrent downloads must be positive, got %d", n)
+	}
+	const dir = "/var/lib/rancher/k3s/agent/etc/containerd"
+	m.Container = m.Container.
+		WithNewFile("/etc/k3s-containerd/v2.toml", fmt.Sprintf("version = 2\n\n[plugins.\"io.containerd.grpc.v1.cri\"]\n  max_concurrent_downloads = %d\n", n)).
+		WithNewFile("/etc/k3s-containerd/v3.toml", fmt.Sprintf("version = 3\n\n[plugins.'io.containerd.cri.v1.images']\n  max_concurrent_downloads = %d\n", n)).
+		// the templates live in the state cache volume, so they can only be
+		// written from an exec.
+		WithExec([]string{"sh", "-c", "mkdir -p " + dir + ` &&
+printf 'imports = ["/etc/k3s-containerd/v2.toml"]\n{{ template "base" . }}\n' > ` + dir + `/config.toml.tmpl &&
+printf 'imports = ["/etc/k3s-containerd/v3.toml"]\n{{ template "base" . }}\n' > ` + dir + `/config-v3.toml.tmpl`})
+	return m, nil
+}
+
+// enables or disables a Kubernetes feature gate on the API server and the
+// kubelet. Setting the same gate again overrides the previous value.
+func (m *K3S) WithFeatureGate(name string, enabled bool) *K3S {
+	gate := fmt.Sprintf("%s=%t", name, enabled)
+	for i, g := range m.FeatureGates {
+		if strings.HasPrefix(g, name+"=") {
+			m.FeatureGates[i] = gate
+			return m
+		}
+	}
+	m.FeatureGates = append(m.FeatureGates, gate)
+	return m
+}
+
+// sets the name of the server node instead of the container hostname
+func (m *K3S) WithNodeName(name string) (*K3S, error) {
+	if len(name) > 253 || !dnsSubdomain.MatchString(name) {
+		return nil, fmt.Errorf("node name %q is not a valid DNS subdomain", name)
+	}
+	m.ServerArgs = append(m.ServerArgs, "--node-name="+name)
+	return m, nil
+}
+
+// passes an extra flag to the kube-controller-manager, e.g.
+// node-monitor-grace-period=20s. Can be called multiple times.
+func (m *K3S) WithKubeControllerArg(arg string) *K3S {
+	m.ServerArgs = append(m.ServerArgs, "--kube-controller-manager-arg="+arg)
+	return m
+}
+
+// disables the embedded k3s cloud controller manager
+func (m *K3S) WithoutCloudController() *K3S {
+	m.ServerArgs = append(m.ServerArgs, "--disable-cloud-controller")
+	return m
+}
+
+// sends API server audit events to a webhook backend.
+//
+// The API server only records events matching an audit policy, so both the
+// policy (audit-policy-file) and the kubeconfig-formatted webhook config
+// (audit-webhook-config-file) are required.
+func (m *K3S) WithAuditWebhook(
+	policy *dagger.File,
+	// kubeconfig file pointing at the webhook endpoint
+	config *dagger.File,
+	// webhook service to bind to the server
+	// +optional
+	service *dagger.Service,
+	// hostname the webhook service is reachable at
+	// +optional
+	// +default="audit"
+	alias string,
+) *K3S {
+	m.Container = m.Container.
+		WithFile("/etc/k3s-audit/policy.yaml", policy).
+		WithFile("/etc/k3s-audit/webhook.yaml", config).
+		With(func(c *dagger.Container) *dagger.Container {
+			if service != nil {
+				c = c.WithServiceBinding(alias, service)
+			}
+			return c
+		})
+	m.ServerArgs = append(m.ServerArgs,
+		"--kube-apiserver-arg=audit-policy-file=/etc/k3s-audit/policy.yaml",
+		"--kube-apiserver-arg=audit-webhook-config-file=/etc/k3s-audit/webhook.yaml",
+	)
+	return m
+}
+
+// sets the cluster join token (K3S_TOKEN) instead of letting k3s generate one,
+// so agents and other servers can be configured upfront. The secret is passed
+// as a secret variable and never shows up in the logs.
+//
+// With keepState the token is persisted along with the cluster state, and a
+// different token on a later run fails the server bootstrap.
+func (m *K3S) WithToken(token *dagger.Secret) *K3S {
+	m.Container = m.Container.WithSecretVariable("K3S_TOKEN", token)
+	return m
+}
+
+// adds DNS search domains to the pods.
+//
+// The domains are added to the resolv.conf given to the kubelet, which appends
+// the node search domains to the ones of ClusterFirst pods (and uses them as is
+// for pods with the Default DNS policy). Works on top of WithResolvConf.
+func (m *K3S) WithPodDNSSearch(domains []string) *K3S {
+	m.Container = m.Container.
+		WithExec([]string{"sh", "-c", fmt.Sprintf(`
+src=/etc/resolv.conf
+[ -f /etc/k3s-resolv.conf ] && src=/etc/k3s-resolv.conf
+awk -v extra=%s '/^search/ { $1 = ""; search = $0; next } { print } END { print "search" search " " extra }' "$src" > /tmp/resolv.conf
+mv /tmp/resolv.conf /etc/k3s-resolv.conf
+`, shellQuote(strings.Join(domains, " ")))})
+	if !slices.Contains(m.ServerArgs, "--resolv-conf=/etc/k3s-resolv.conf") {
+		m.ServerArgs = append(m.ServerArgs, "--resolv-conf=/etc/k3s-resolv.conf")
+	}
+	return m
+}
+
+// schedules etcd snapshots with the given cron expression, keeping the last
+// retention snapshots. Snapshots require the embedded etcd datastore, so the
+// server is started with --cluster-init.
+func (m *K3S) WithEtcdSnapshots(
+	// +optional
+	// +default="0 */12 * * *"
+	cron string,
+	// +optional
+	// +default=5
+	retention int,
+) (*K3S, error) {
+	if len(strings.Fields(cron)) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q", cron)
+	}
+	if retention <= 0 {
+		return nil, fmt.Errorf("snapshot retention must be positive, got %d", retention)
+	}
+	if !slices.Contains(m.ServerArgs, "--cluster-init") {
+		m.ServerArgs = append(m.ServerArgs, "--cluster-init")
+	}
+	m.ServerArgs = append(m.ServerArgs,
+		"--etcd-snapshot-schedule-cron="+cron,
+		"--etcd-snapshot-retention="+strconv.Itoa(retention),
+	)
+	return m, nil
+}
+
+// adds a HelmChart custom resource to the k3s auto-deploy manifests, so the
+// embedded helm controller installs the chart when the server starts. Can be
+// called multiple times.
+func (m *K3S) WithHelmChartCR(file *dagger.File) *K3S {
+	const dir = "/var/lib/rancher/k3s/server/manifests"
+	m.Container = m.Container.
+		WithFile("/tmp/helmchart.yaml", file).
+		// the manifests live in the state cache volume, so they can only be
+		// copied from an exec. Naming them by content keeps them apart.
+		WithExec([]string{"sh", "-c", "mkdir -p " + dir + ` && cp /tmp/helmchart.yaml "` + dir + `/helmchart-$(sha256sum /tmp/helmchart.yaml | cut -c1-12).yaml"`}).
+		WithoutFile("/tmp/helmchart.yaml")
+	return m
+}
+
+// pulls the given images into containerd as soon as the server starts, to warm
+// the image store and catch registry or auth problems early. A failed pull
+// stops the server and its error is returned by Config, which also waits for
+// the pulls to complete.
+func (m *K3S) PrePullImages(ctx context.Context, images []string) *K3S {
+	for _, image := range images {
+		m.PrePulledImages = append(m.PrePulledImages, normalizeImageRef(image))
+	}
+	m.Container = m.Container.WithEnvVariable("K3S_PREPULL_IMAGES", strings.Join(m.PrePulledImages, " "))
+	return m
+}
+
+// selects the kubeconfig context used by the kubectl, helm and k9s helpers
+// (kubectl --context). The cluster's own kubeconfig only has the default
+// context, other contexts come from kubeconfigs merged with it, so that the
+// helpers can target other clusters. The merged kubeconfigs have to be self
+// contained and their entries named other than default, which is taken by
+// the cluster's own entries.
+func (m *K3S) WithKubectlContext(
+	name string,
+	// kubeconfig to merge with the cluster's, can be given once per call
+	// +optional
+	kubeconfig *dagger.File,
+) *K3S {
+	m.KubectlContext = name
+	if kubeconfig != nil {
+		m.KubectlConfigs = append(m.KubectlConfigs, kubeconfig)
+	}
+	return m
+}
+
+// passes an extra flag to the kube-scheduler, e.g. config=/path/to/config.yaml.
+// Can be called multiple times.
+func (m *K3S) WithKubeSchedulerArg(arg string) *K3S {
+	m.ServerArgs = append(m.ServerArgs, "--kube-scheduler-arg="+arg)
+	return m
+}
+
+// binds the API server to the given address instead of the one detected from
+// the container routes, which can pick the wrong interface on multi-homed
+// containers
+func (m *K3S) WithBindAddress(addr string) (*K3S, error) {
+	if net.ParseIP(addr) == nil {
+		return nil, fmt.Errorf("bind address %q is not an IP address", addr)
+	}
+	m.Container = m.Container.WithEnvVariable("BIND_ADDRESS", addr)
+	return m, nil
+}
+
+// sets the maximum number of pods the node runs (110 by default)
+func (m *K3S) WithMaxPods(n int) (*K3S, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("max pods must be positive, got %d", n)
+	}
+	m.ServerArgs = append(m.ServerArgs, "--kubelet-arg=max-pods="+strconv.Itoa(n))
+	return m, nil
+}
+
+// prefixes the k3s system images (pause, coredns, local-path-provisioner, ...)
+// with the given registry so they are pulled from it. Credentials or TLS
+// settings for that registry still come from registries.yaml, and workload
+// images are not affected.
+func (m *K3S) WithSystemDefaultRegistry(registry string) *K3S {
+	m.ServerArgs = append(m.ServerArgs, "--system-default-registry="+registry)
+	return m
+}
+
+// sets the interface flannel uses for the pod network (--flannel-iface)
+// instead of the one of the default route, see also WithBindAddress
+func (m *K3S) WithFlannelIface(iface string) *K3S {
+	m.ServerArgs = append(m.ServerArgs, "--flannel-iface="+iface)
+	return m
+}
+
+// sets the API server request timeout (--request-timeout), e.g. 30s or 1m
+func (m *K3S) WithApiServerTimeout(timeout string) (*K3S, error) {
+	if _, err := time.ParseDuration(timeout); err != nil {
+		return nil, fmt.Errorf("invalid API server timeout: %w", err)
+	}
+	m.ServerArgs = append(m.ServerArgs, "--kube-apiserver-arg=request-timeout="+timeout)
+	return m, nil
+}
+
+// limits the number of requests the API server handles concurrently, requests
+// above the limits are rejected with 429 Too Many Requests
+func (m *K3S) WithApiServerMaxRequestsInflight(
+	// limit for non-mutating requests
+	// +optional
+	// +default=400
+	maxRequests int,
+	// limit for mutating requests
+	// +optional
+	// +default=200
+	maxMutatingRequests int,
+) (*K3S, error) {
+	if maxRequests <= 0 || maxMutatingRequests <= 0 {
+		return nil, fmt.Errorf("max requests inflight must be positive, got %d and %d", maxRequests, maxMutatingRequests)
+	}
+	m.ServerArgs = append(m.ServerArgs,
+		"--kube-apiserver-arg=max-requests-inflight="+strconv.Itoa(maxRequests),
+		"--kube-apiserver-arg=max-mutating-requests-inflight="+strconv.Itoa(maxMutatingRequests),
+	)
+	return m, nil
+}
+
+// configures the kubelet with the given KubeletConfiguration file.
+//
+// Kubelet flags take precedence over the file, so settings k3s passes as flags
+// on its own, or set through options like WithMaxPods, override the values of
+// the file.
+func (m *K3S) WithKubeletConfig(file *dagger.File) *K3S {
+	m.Container = m.Container.WithFile("/etc/k3s-kubelet/config.yaml", file)
+	m.ServerArgs = append(m.ServerArgs, "--kubelet-arg=config=/etc/k3s-kubelet/config.yaml")
+	return m
+}
+
+// enables the embedded distributed registry mirror (Spegel), letting nodes pull
+// images from each other. All registries are mirrored through a registries.yaml
+// wildcard entry, unless a registries.yaml was written earlier in the chain,
+// e.g. through WithContainer, in which case it has to list the registries to
+// mirror itself. The file doesn't outlive the run.
+func (m *K3S) WithEmbeddedRegistry() *K3S {
+	m.Container = m.Container.
+		// registries.yaml lives in the config cache volume, so it can only
+		// be written from an exec.
+		WithExec([]string{"sh", "-c", `[ -f /etc/rancher/k3s/registries.yaml ] || printf 'mirrors:\n  "*":\n' > /etc/rancher/k3s/registries.yaml`})
+	m.ServerArgs = append(m.ServerArgs, "--embedded-registry")
+	return m
+}
+
+// sets the kubelet cgroup driver, systemd or cgroupfs, which has to match the
+// one containerd uses.
+//
+// k3s picks cgroupfs inside the container since there is no systemd managing
+// the cgroups; the entrypoint only moves the processes out of the root cgroup
+// and enables the cgroup v2 controllers, and works with either driver.
+func (m *K3S) WithCgroupDriver(driver string) (*K3S, error) {
+	if driver != "systemd" && driver != "cgroupfs" {
+		return nil, fmt.Errorf("unsupported cgroup driver %q", driver)
+	}
+	m.ServerArgs = append(m.ServerArgs, "--kubelet-arg=cgroup-driver="+driver)
+	return m, nil
+}
+
+// adds a hostname or IP to the subject alternative names of the API server
+// certificate (--tls-san), so clients can reach the server under that name.
+// Can be called multiple times.
+func (m *K3S) WithTLSSan(san string) *K3S {
+	m.ServerArgs = append(m.ServerArgs, "--tls-san="+san)
+	return m
+}
+
+// retries kubectl invocations of the helpers up to n times when they fail with
+// transient API server errors, e.g. connection refused while the server is
+// still starting
+func (m *K3S) WithKubectlRetries(n int) (*K3S, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("kubectl retries must not be negative, got %d", n)
+	}
+	m.KubectlRetries = n
+	return m, nil
+}
+
+// sets the pod and service CIDRs, e.g. 10.42.0.0/16,2001:cafe:42::/56 and
+// 10.43.0.0/16,2001:cafe:43::/112, each list holding at most one IPv4 and one
+// IPv6 range in the same families. IPv6 pod traffic leaving the node is
+// masqueraded (--flannel-ipv6-masq) since the ranges aren't routable outside
+// the cluster. IPv6 has to be available in the engine container network.
+func (m *K3S) WithDualStack(clusterCIDRs string, serviceCIDRs string) (*K3S, error) {
+	clusterFamilies, err := cidrFamilies(clusterCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster CIDRs: %w", err)
+	}
+	serviceFamilies, err := cidrFamilies(serviceCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service CIDRs: %w", err)
+	}
+	if !slices.Equal(clusterFamilies, serviceFamilies) {
+		return nil, fmt.Errorf("cluster CIDRs (%s) and service CIDRs (%s) must have the same IP families", clusterCIDRs, serviceCIDRs)
+	}
+	m.ServerArgs = append(m.ServerArgs, "--cluster-cidr="+clusterCIDRs, "--service-cidr="+serviceCIDRs)
+	if slices.Contains(clusterFamilies, "ipv6") {
+		m.ServerArgs = append(m.ServerArgs, "--flannel-ipv6-masq")
+	}
+	return m, nil
+}
+
+// encrypts secrets at rest in the datastore (--secrets-encryption), see
+// SecretsEncryptionStatus to check it's in effect
+func (m *K3S) WithSecretsEncryption() *K3S {
+	m.ServerArgs = append(m.ServerArgs, "--secrets-encryption")
+	return m
+}
+
+// replaces the server container. Dagger functions can't take Go functions as
+// arguments, so to apply arbitrary transformations pass the modified container:
+//
+//	k3s.With(func(k *dagger.K3S) *dagger.K3S {
+//		return k.WithContainer(k.Container().With(fn))
+//	})
 func (m *K3S) WithContainer(c *dagger.Container) *K3S {
 	m.Container = c
 	return m
@@ -124,15 +924,56 @@ func (m *K3S) Config(ctx context.Context,
 	// +default=false
 	local bool,
 
+	// sets the default namespace of the kubeconfig context
+	// +optional
+	namespace string,
+
+	// checks that the credentials work by running kubectl cluster-info
+	// +optional
+	// +default=false
+	validate bool,
+
+	// name of the returned file, defaults to k3s.yaml. Useful to avoid
+	// collisions when exporting the configs of several clusters together.
+	// +optional
+	filename string,
+
+	// seconds to wait for the server to write the config, 0 waits forever.
+	// The wait is aborted early when the server exits.
+	// +optional
+	// +default=0
+	timeout int,
+
+	// renames the cluster entry (clusters[].name), which is "default" otherwise.
+	// Keeps the configs of several clusters apart once merged.
+	// +optional
+	clusterName string,
 ) *dagger.File {
 	const interval = 0.5
-	return dag.Container().
+	config := dag.Container().
 		From("alpine").
-		// we need to bust the cache so we don't fetch the same file each time.
-		WithEnvVariable("CACHE", time.Now().String()).
+		// the cache is busted once per cluster instance: the kubeconfig is
+		// regenerated on every start, but repeated calls can reuse it.
+		WithEnvVariable("CACHE", m.Generation).
 		WithMountedCache("/cache/k3s", m.ConfigCache).
-		WithExec([]string{"sh", "-c", `while [ ! -f "/cache/k3s/k3s.yaml" ]; do echo "k3s.yaml not ready, is sever started?. waiting.. " && sleep ` + fmt.Sprintf("%.1f", interval) + `; done`}).
+		WithExec([]string{"sh", "-c", fmt.Sprintf(`
+end=$(( $(date +%%s) + %d ))
+current() { [ "$(cat /cache/k3s/generation 2>/dev/null)" = %s ]; }
+while ! current || [ ! -f "/cache/k3s/k3s.yaml" ] || { [ %t = true ] && [ ! -f /cache/k3s/prepull.done ]; }; do
+  # the marker of a previous run's shutdown doesn't count.
+  if current && [ -f /cache/k3s/server.exited ]; then cat /cache/k3s/server.exited >&2; exit 1; fi
+  if [ %d -gt 0 ] && [ "$(date +%%s)" -ge "$end" ]; then echo "k3s.yaml not ready after %ds" >&2; exit 1; fi
+  echo "k3s.yaml not ready, is sever started?. waiting.. " && sleep %.1f
+done`, timeout, shellQuote(m.Generation), len(m.PrePulledImages) > 0, timeout, timeout, interval)}).
 		WithExec([]string{"cp", "/cache/k3s/k3s.yaml", "k3s.yaml"}).
+		With(func(c *dagger.Container) *dagger.Container {
+			if validate {
+				// the validated copy replaces the original so the check
+				// becomes part of the pipeline producing the file.
+				c = c.WithFile("k3s.yaml", validateConfig(c.File("k3s.yaml")))
+			}
+			return c
+		}).
 		With(func(c *dagger.Container) *dagger.Container {
 			if local {
 				c = c.WithExec([]string{"sed", "-i", fmt.Sprintf(`s/https:.*:%d/https://localhost:%d/g`, m.Port, m.Port),
@@ -141,23 +982,184 @@ func (m *K3S) Config(ctx context.Context,
 			}
 			return c
 		}).
-		File("k3s.yaml")
-}
-
-// runs kubectl on the target k3s cluster
+		With(func(c *dagger.Container) *dagger.Container {
+			if namespace != "" {
+				c = c.WithExec([]string{"sh", "-c", fmt.Sprintf(
+					`awk -v ns=%s '{print} /^    cluster: default$/{print "    namespace: " ns}' k3s.yaml > k3s.yaml.tmp && mv k3s.yaml.tmp k3s.yaml`,
+					shellQuote(namespace),
+				)})
+			}
+			return c
+		}).
+		With(func(c *dagger.Container) *dagger.Container {
+			if clusterName != "" {
+				c = c.WithExec([]string{"sh", "-c", fmt.Sprintf(
+					`awk -v name=%s '/^[a-z-]+:/ { section = $1 }
+section == "clusters:" && /^  name: default$/ { $0 = "  name: " name }
+section == "contexts:" && /^    cluster: default$/ { $0 = "    cluster: " name }
+{ print }' k3s.yaml > k3s.yaml.tmp && mv k3s.yaml.tmp k3s.yaml`,
+					shellQuote(clusterName),
+				)})
+			}
+			return c
+		}).
+		File("k3s.yaml")
+	if filename != "" {
+		config = config.WithName(filename)
+	}
+	return config
+}
+
+// returns a kubeconfig for use outside of the pipeline, pointing at host:port
+// and with its cluster, user and context named contextName so that it merges
+// with other kubeconfigs without collisions. The host has to be one the server
+// certificate is valid for: localhost, the container address or a name added
+// with WithTLSSan.
+func (m *K3S) ExportKubeconfig(ctx context.Context,
+	contextName string,
+	// +optional
+	// +default="localhost"
+	host string,
+	// defaults to the API server port
+	// +optional
+	port int,
+) *dagger.File {
+	if port == 0 {
+		port = m.Port
+	}
+	return dag.Container().
+		From("alpine").
+		WithFile("/kubeconfig.yaml", m.kubeconfig(ctx)).
+		WithExec([]string{"sh", "-c", fmt.Sprintf(
+			`awk -v name=%s -v server=%s '
+/^    server: / { $0 = "    server: " server }
+/^(  name|- name|    cluster|    user|current-context): default$/ { sub(/default$/, name) }
+{ print }' /kubeconfig.yaml > /exported.yaml`,
+			shellQuote(contextName), shellQuote(fmt.Sprintf("https://%s:%d", host, port)),
+		)}).
+		File("/exported.yaml").
+		WithName(contextName + ".yaml")
+}
+
+// returns the in-cluster config file with the default options
+func (m *K3S) kubeconfig(ctx context.Context) *dagger.File {
+	return m.Config(ctx, false, "", false, "", 0, "")
+}
+
+// returns the kubeconfig used by the helpers: the in-cluster one merged with
+// the kubeconfigs of WithKubectlContext and switched to the selected context
+func (m *K3S) helperKubeconfig(ctx context.Context) *dagger.File {
+	config := m.kubeconfig(ctx)
+	if m.KubectlContext == "" {
+		return config
+	}
+	paths := []string{"/kube/k3s.yaml"}
+	ctr := dag.Container().
+		From("bitnami/kubectl").
+		WithoutEntrypoint().
+		WithFile(paths[0], config)
+	for i, file := range m.KubectlConfigs {
+		path := fmt.Sprintf("/kube/merged-%d.yaml", i)
+		ctr = ctr.WithFile(path, file)
+		paths = append(paths, path)
+	}
+	return ctr.
+		WithEnvVariable("KUBECONFIG", strings.Join(paths, ":")).
+		WithExec([]string{"sh", "-c", `kubectl config view --flatten > /tmp/kubeconfig && KUBECONFIG=/tmp/kubeconfig kubectl config use-context "$0"`, m.KubectlContext}).
+		File("/tmp/kubeconfig")
+}
+
+// returns the contents of the config file for the k3s cluster
+func (m *K3S) ConfigContents(ctx context.Context,
+	// +optional
+	// +default=false
+	local bool,
+) (string, error) {
+	return m.Config(ctx, local, "", false, "", 0, "").Contents(ctx)
+}
+
+// runs kubectl on the target k3s cluster
 func (m *K3S) Kubectl(ctx context.Context, args string) *dagger.Container {
+	return m.kubectlContainer(ctx).
+		WithExec([]string{"sh", "-c", "kubectl " + args})
+}
+
+// runs a shell script on the target k3s cluster. kubectl is available in the PATH
+// and already configured to talk to the cluster.
+func (m *K3S) RunScript(ctx context.Context, script string) *dagger.Container {
+	return m.kubectlContainer(ctx).
+		WithNewFile("/tmp/script.sh", script).
+		WithExec([]string{"sh", "/tmp/script.sh"})
+}
+
+// runs a shell script like RunScript, returning its output and exit code
+// instead of failing
+func (m *K3S) scriptResult(ctx context.Context, script string) (*KubectlResult, error) {
+	return m.scriptResultWithin(ctx, m.helperKubeconfig(ctx), script)
+}
+
+// runs a shell script like scriptResult with the given kubeconfig
+func (m *K3S) scriptResultWithin(ctx context.Context, config *dagger.File, script string) (*KubectlResult, error) {
+	ctr, err := m.kubectlContainerWithin(ctx, config).
+		WithNewFile("/tmp/script.sh", script).
+		WithExec([]string{"sh", "/tmp/script.sh"}, dagger.ContainerWithExecOpts{
+			Expect: dagger.ReturnTypeAny,
+		}).
+		Sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newKubectlResult(ctx, ctr)
+}
+
+// returns a container with helm configured to talk to the k3s cluster
+func (m *K3S) helmContainer(ctx context.Context) *dagger.Container {
+	return dag.Container().
+		From("alpine/helm").
+		WithoutEntrypoint().
+		WithEnvVariable("CACHE", time.Now().String()).
+		WithEnvVariable("KUBECONFIG", "/.kube/config").
+		WithFile("/.kube/config", m.helperKubeconfig(ctx))
+}
+
+// returns a container with kubectl configured to talk to the k3s cluster
+func (m *K3S) kubectlContainer(ctx context.Context) *dagger.Container {
+	return m.kubectlContainerWithin(ctx, m.helperKubeconfig(ctx))
+}
+
+// returns a container like kubectlContainer configured with the given
+// kubeconfig, e.g. the cluster's own one to check the health of the server
+// regardless of the context selected with WithKubectlContext
+func (m *K3S) kubectlContainerWithin(ctx context.Context, config *dagger.File) *dagger.Container {
 	return dag.Container().
 		From("bitnami/kubectl").
 		WithoutEntrypoint().
 		WithMountedCache("/cache/k3s", m.ConfigCache).
 		WithEnvVariable("CACHE", time.Now().String()).
-		WithFile("/.kube/config", m.Config(ctx, false), dagger.ContainerWithFileOpts{Permissions: 1001}).
+		WithFile("/.kube/config", config, dagger.ContainerWithFileOpts{Permissions: 1001}).
 		WithUser("1001").
-		WithExec([]string{"sh", "-c", "kubectl " + args})
+		With(func(c *dagger.Container) *dagger.Container {
+			if m.KubectlRetries > 0 {
+				c = c.
+					WithNewFile("/opt/k3s-retry/kubectl", kubectlRetry, dagger.ContainerWithNewFileOpts{Permissions: 0o755}).
+					WithEnvVariable("KUBECTL_RETRIES", strconv.Itoa(m.KubectlRetries)).
+					WithEnvVariable("PATH", "/opt/k3s-retry:${PATH}", dagger.ContainerWithEnvVariableOpts{Expand: true})
+			}
+			return c
+		})
 }
 
 // runs k9s on the target k3s cluster
-func (m *K3S) Kns(ctx context.Context) *dagger.Container {
+func (m *K3S) Kns(ctx context.Context,
+	// terminal command to run instead of k9s, e.g. ["k9s", "--readonly"] or
+	// ["sh"]. The container only ships k9s, so other tools like kubectl have
+	// to be installed by the command itself.
+	// +optional
+	command []string,
+) *dagger.Container {
+	if len(command) == 0 {
+		command = []string{"k9s"}
+	}
 	return dag.Container().
 		From("alpine:latest").
 		WithExec([]string{"apk", "add", "--no-cache", "curl", "tar"}).
@@ -169,9 +1171,1462 @@ func (m *K3S) Kns(ctx context.Context) *dagger.Container {
 		WithMountedCache("/cache/k3s", m.ConfigCache).
 		WithEnvVariable("CACHE", time.Now().String()).
 		WithEnvVariable("KUBECONFIG", "/.kube/config").
-		WithFile("/.kube/config", m.Config(ctx, false), dagger.ContainerWithFileOpts{Permissions: 1001}).
+		WithFile("/.kube/config", m.helperKubeconfig(ctx), dagger.ContainerWithFileOpts{Permissions: 1001}).
 		// Terminal().
-		WithDefaultTerminalCmd([]string{"k9s"})
+		WithDefaultTerminalCmd(command)
+}
+
+// PodMetric is the resource usage of a single pod as reported by metrics-server
+type PodMetric struct {
+	Namespace string
+	Name      string
+	// CPU usage in millicores
+	CPUMillicores int
+	// memory usage in mebibytes
+	MemoryMebibytes int
+}
+
+// returns the resource usage of the pods in the given namespace (all namespaces
+// when empty). Requires metrics-server, see the disableMetricsServer option of New.
+func (m *K3S) PodMetrics(ctx context.Context,
+	// +optional
+	namespace string,
+) ([]PodMetric, error) {
+	scope := "--all-namespaces"
+	if namespace != "" {
+		scope = "-n " + namespace
+	}
+	out, err := m.Kubectl(ctx, "top pods --no-headers "+scope).Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var metrics []PodMetric
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		metric := PodMetric{Namespace: namespace}
+		if namespace == "" {
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("unexpected kubectl top output: %q", line)
+			}
+			metric.Namespace, fields = fields[0], fields[1:]
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected kubectl top output: %q", line)
+		}
+		metric.Name = fields[0]
+		if metric.CPUMillicores, err = parseQuantity(fields[1], "m"); err != nil {
+			return nil, err
+		}
+		if metric.MemoryMebibytes, err = parseQuantity(fields[2], "Mi"); err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, nil
+}
+
+// marks the given node as unschedulable
+func (m *K3S) CordonNode(ctx context.Context, node string) *dagger.Container {
+	return m.Kubectl(ctx, "cordon "+node)
+}
+
+// marks the given node as schedulable again
+func (m *K3S) UncordonNode(ctx context.Context, node string) *dagger.Container {
+	return m.Kubectl(ctx, "uncordon "+node)
+}
+
+// cordons the given node and evicts all of its pods. DaemonSet pods are left in
+// place and emptyDir data is discarded.
+func (m *K3S) DrainNode(ctx context.Context, node string) *dagger.Container {
+	return m.Kubectl(ctx, "drain "+node+" --ignore-daemonsets --delete-emptydir-data")
+}
+
+// containerStatus is the part of a pod container status the wait helpers use
+type containerStatus struct {
+	Image string `json:"image"`
+	State struct {
+		Waiting *struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"waiting"`
+	} `json:"state"`
+}
+
+// KubectlResult is the outcome of a kubectl invocation
+type KubectlResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// runs kubectl on the target k3s cluster and returns its output and exit code.
+// A non-zero exit code is not considered an error, which allows asserting on
+// expected failures such as denied requests.
+func (m *K3S) KubectlResult(ctx context.Context, args string) (*KubectlResult, error) {
+	ctr, err := m.kubectlContainer(ctx).
+		WithExec([]string{"sh", "-c", "kubectl " + args}, dagger.ContainerWithExecOpts{
+			Expect: dagger.ReturnTypeAny,
+		}).
+		Sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newKubectlResult(ctx, ctr)
+}
+
+// waits until the given resource (e.g. deployment/nginx) reports the given
+// condition (e.g. Available)
+func (m *K3S) WaitFor(ctx context.Context,
+	resource string,
+	condition string,
+	// +optional
+	namespace string,
+	// timeout in seconds
+	// +optional
+	// +default=120
+	timeout int,
+) error {
+	res, err := m.KubectlResult(ctx, fmt.Sprintf("wait --for=condition=%s %s %s --timeout=%ds",
+		condition, resource, namespaceFlag(namespace), timeout))
+	if err != nil {
+		return err
+	}
+	if res.ExitCode == 0 {
+		return nil
+	}
+	status, err := m.Kubectl(ctx, fmt.Sprintf("get %s %s -o jsonpath='{.status}'", resource, namespaceFlag(namespace))).Stdout(ctx)
+	if err != nil {
+		status = err.Error()
+	}
+	return fmt.Errorf("%s did not become %s within %ds: %s\nlast status: %s",
+		resource, condition, timeout, strings.TrimSpace(res.Stderr), status)
+}
+
+// returns the kubectl describe output of the given resource
+func (m *K3S) Describe(ctx context.Context,
+	kind string,
+	name string,
+	// +optional
+	namespace string,
+) (string, error) {
+	return m.Kubectl(ctx, fmt.Sprintf("describe %s %s %s", kind, name, namespaceFlag(namespace))).Stdout(ctx)
+}
+
+// ClusterInfo summarizes the state of the cluster
+type ClusterInfo struct {
+	// Kubernetes version reported by the API server
+	Version string
+	Nodes   int
+	// number of nodes with the Ready condition
+	ReadyNodes int
+	// URL of the API server
+	Endpoint string
+}
+
+// returns a summary of the cluster
+func (m *K3S) Info(ctx context.Context) (*ClusterInfo, error) {
+	var version struct {
+		ServerVersion struct {
+			GitVersion string `json:"gitVersion"`
+		} `json:"serverVersion"`
+	}
+	if err := m.kubectlJSON(ctx, "version", &version); err != nil {
+		return nil, err
+	}
+
+	var nodes struct {
+		Items []struct {
+			Status struct {
+				Conditions []struct {
+					Type   string `json:"type"`
+					Status string `json:"status"`
+				} `json:"conditions"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := m.kubectlJSON(ctx, "get nodes", &nodes); err != nil {
+		return nil, err
+	}
+
+	endpoint, err := m.Kubectl(ctx, "config view --minify -o jsonpath='{.clusters[0].cluster.server}'").Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ClusterInfo{
+		Version:  version.ServerVersion.GitVersion,
+		Nodes:    len(nodes.Items),
+		Endpoint: endpoint,
+	}
+	for _, node := range nodes.Items {
+		for _, cond := range node.Status.Conditions {
+			if cond.Type == "Ready" && cond.Status == "True" {
+				info.ReadyNodes++
+			}
+		}
+	}
+	return info, nil
+}
+
+// installs or upgrades a helm chart on the target k3s cluster. Values files are
+// applied in the given order, followed by the --set overrides. Charts can be
+// pulled from OCI registries with oci:// references, logging in first when
+// credentials are given.
+func (m *K3S) HelmInstall(ctx context.Context,
+	release string,
+	// chart reference, e.g. a repo/chart name, a chart URL or an oci:// reference
+	chart string,
+	// +optional
+	// +default="default"
+	namespace string,
+	// values files, later files take precedence
+	// +optional
+	values []*dagger.File,
+	// key=value overrides passed as --set, applied after the values files
+	// +optional
+	set []string,
+	// username to log in to the OCI registry of an oci:// chart
+	// +optional
+	registryUsername string,
+	// password to log in to the OCI registry of an oci:// chart
+	// +optional
+	registryPassword *dagger.Secret,
+) *dagger.Container {
+	ctr := m.helmContainer(ctx)
+	if registryPassword != nil && strings.HasPrefix(chart, "oci://") {
+		host, _, _ := strings.Cut(strings.TrimPrefix(chart, "oci://"), "/")
+		ctr = ctr.
+			WithSecretVariable("REGISTRY_PASSWORD", registryPassword).
+			WithExec([]string{"sh", "-c", `printf '%s' "$REGISTRY_PASSWORD" | helm registry login "$0" --username "$1" --password-stdin`, host, registryUsername})
+	}
+	args := []string{"helm", "upgrade", "--install", release, chart, "--namespace", namespace, "--create-namespace"}
+	for i, file := range values {
+		path := fmt.Sprintf("/values/%d.yaml", i)
+		ctr = ctr.WithFile(path, file)
+		args = append(args, "--values", path)
+	}
+	for _, s := range set {
+		args = append(args, "--set", s)
+	}
+	return ctr.WithExec(args)
+}
+
+// returns whether the given resource exists
+func (m *K3S) Exists(ctx context.Context,
+	kind string,
+	name string,
+	// +optional
+	namespace string,
+) (bool, error) {
+	res, err := m.KubectlResult(ctx, fmt.Sprintf("get %s %s %s -o name", kind, name, namespaceFlag(namespace)))
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case res.ExitCode == 0:
+		return true, nil
+	case strings.Contains(res.Stderr, "(NotFound)"):
+		return false, nil
+	default:
+		return false, fmt.Errorf("getting %s %s: %s", kind, name, strings.TrimSpace(res.Stderr))
+	}
+}
+
+// restarts the pods of the given deployment, e.g. to pick up configuration
+// changes
+func (m *K3S) RolloutRestart(ctx context.Context,
+	namespace string,
+	deployment string,
+	// waits for the rollout to complete
+	// +optional
+	// +default=false
+	wait bool,
+	// timeout in seconds when waiting for the rollout
+	// +optional
+	// +default=120
+	timeout int,
+) *dagger.Container {
+	ctr := m.Kubectl(ctx, fmt.Sprintf("rollout restart deployment/%s -n %s", deployment, namespace))
+	if wait {
+		ctr = ctr.WithExec([]string{"sh", "-c", fmt.Sprintf("kubectl rollout status deployment/%s -n %s --timeout=%ds", deployment, namespace, timeout)})
+	}
+	return ctr
+}
+
+// requests the given URL from a throwaway pod inside the cluster and returns the
+// response body. The pod is removed once the request completes.
+func (m *K3S) CurlInCluster(ctx context.Context, url string) (string, error) {
+	name := fmt.Sprintf("curl-%d", time.Now().UnixNano())
+	return m.Kubectl(ctx, fmt.Sprintf("run %s --image=curlimages/curl --restart=Never --rm -i --quiet -- -fsS %s", name, shellQuote(url))).Stdout(ctx)
+}
+
+// checks that the cluster can run workloads by deploying nginx behind a service
+// in a temporary namespace and requesting it from inside the cluster
+func (m *K3S) SmokeTest(ctx context.Context) (rerr error) {
+	ns := fmt.Sprintf("smoke-%d", time.Now().UnixNano())
+	if _, err := m.Kubectl(ctx, "create namespace "+ns).Sync(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		_, err := m.Kubectl(ctx, "delete namespace "+ns+" --wait=false").Sync(ctx)
+		if rerr == nil {
+			rerr = err
+		}
+	}()
+
+	if _, err := m.Kubectl(ctx, "run nginx --image=nginx --port=80 --expose -n "+ns).Sync(ctx); err != nil {
+		return err
+	}
+	if err := m.WaitFor(ctx, "pod/nginx", "Ready", ns, 120); err != nil {
+		return err
+	}
+	if _, err := m.CurlInCluster(ctx, "http://nginx."+ns+".svc.cluster.local"); err != nil {
+		return fmt.Errorf("nginx is not reachable through its service: %w", err)
+	}
+	return nil
+}
+
+// runs kubectl on the target k3s cluster impersonating the given user and
+// groups, e.g. to check RBAC rules
+func (m *K3S) KubectlAs(ctx context.Context,
+	user string,
+	// +optional
+	groups []string,
+	args string,
+) *dagger.Container {
+	return m.Kubectl(ctx, impersonationFlags(user, groups)+" "+args)
+}
+
+// same as KubectlAs but returns the output and exit code instead of failing, so
+// that denied requests can be asserted on
+func (m *K3S) KubectlAsResult(ctx context.Context,
+	user string,
+	// +optional
+	groups []string,
+	args string,
+) (*KubectlResult, error) {
+	return m.KubectlResult(ctx, impersonationFlags(user, groups)+" "+args)
+}
+
+// waits until all replicas of the given StatefulSet are ready
+func (m *K3S) WaitForStatefulSet(ctx context.Context,
+	namespace string,
+	name string,
+	// timeout in seconds
+	// +optional
+	// +default=120
+	timeout int,
+) error {
+	res, err := m.KubectlResult(ctx, fmt.Sprintf("rollout status statefulset/%s -n %s --timeout=%ds", name, namespace, timeout))
+	if err != nil {
+		return err
+	}
+	if res.ExitCode == 0 {
+		return nil
+	}
+	replicas, err := m.Kubectl(ctx, fmt.Sprintf("get statefulset/%s -n %s -o jsonpath='{.status.readyReplicas}/{.spec.replicas}'", name, namespace)).Stdout(ctx)
+	if err != nil {
+		replicas = "unknown"
+	}
+	return fmt.Errorf("statefulset %s/%s not ready within %ds (%s replicas ready): %s",
+		namespace, name, timeout, replicas, strings.TrimSpace(res.Stderr))
+}
+
+// returns a k3s agent config file with the server URL and join token, ready to
+// be used as /etc/rancher/k3s/config.yaml to join nodes running outside of
+// Dagger to the cluster.
+//
+// The nodes can't reach the server at its address on the engine network, so
+// the URL points at host:port, where the server port has to be exposed, e.g.
+// with `dagger call ... server up`. Like for ExportKubeconfig, the host has to
+// be one the server certificate is valid for, which takes WithTLSSan for
+// anything but localhost and the container address.
+func (m *K3S) AgentConfig(ctx context.Context,
+	// host the nodes reach the server at
+	host string,
+	// defaults to the API server port
+	// +optional
+	port int,
+) (*dagger.Secret, error) {
+	if port == 0 {
+		port = m.Port
+	}
+	config, err := dag.Container().
+		From("alpine").
+		WithEnvVariable("CACHE", m.Generation).
+		// the kubeconfig of this instance is only written once the server
+		// is up, so the token can't be the one of a previous run.
+		WithFile("/k3s.yaml", m.kubeconfig(ctx)).
+		WithMountedCache("/var/lib/rancher", m.StateCache).
+		WithExec([]string{"sh", "-c", `while [ ! -f /var/lib/rancher/k3s/server/token ]; do echo "token not ready, is server started?. waiting.. " && sleep 0.5; done`}).
+		// written to a file so the token doesn't show up in the logs.
+		WithExec([]string{"sh", "-c", fmt.Sprintf(`printf 'server: %%s\ntoken: %%s\n' %s "$(cat /var/lib/rancher/k3s/server/token)" > /agent.yaml`,
+			shellQuote(fmt.Sprintf("https://%s:%d", host, port)))}).
+		File("/agent.yaml").
+		Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dag.SetSecret("k3s_agent_config_"+m.Name, config), nil
+}
+
+// applies the manifest at the given URL. The manifest is downloaded by kubectl,
+// so the URL has to be reachable from the pipeline.
+func (m *K3S) ApplyFromURL(ctx context.Context,
+	url string,
+	// namespace for the namespaced resources that don't set one. kubectl
+	// refuses to apply resources that hardcode a different namespace.
+	// +optional
+	namespace string,
+	// validates without persisting anything: server runs the admission
+	// chain and schema validation, client only checks the manifests locally
+	// +optional
+	dryRun string,
+) *dagger.Container {
+	return m.Kubectl(ctx, "apply -f "+shellQuote(url)+" "+namespaceFlag(namespace)+dryRunFlag(dryRun))
+}
+
+// waits until the given LoadBalancer service is assigned an ingress IP and
+// returns it
+func (m *K3S) WaitForLoadBalancerIP(ctx context.Context,
+	namespace string,
+	service string,
+	// timeout in seconds
+	// +optional
+	// +default=120
+	timeout int,
+) (string, error) {
+	res, err := m.scriptResult(ctx, fmt.Sprintf(`
+end=$(( $(date +%%s) + %d ))
+while [ "$(date +%%s)" -lt "$end" ]; do
+  ip=$(kubectl get service %s -n %s -o jsonpath='{.status.loadBalancer.ingress[0].ip}')
+  if [ -n "$ip" ]; then printf '%%s' "$ip"; exit 0; fi
+  sleep 1
+done
+exit 1
+`, timeout, service, namespace))
+	if err != nil {
+		return "", err
+	}
+	if res.ExitCode != 0 {
+		return "", fmt.Errorf("service %s/%s got no load balancer IP within %ds: %s",
+			namespace, service, timeout, strings.TrimSpace(res.Stderr))
+	}
+	return res.Stdout, nil
+}
+
+// exports every resource of the given namespace as YAML, one file per resource
+// named <type>/<name>.yaml. Events are skipped.
+func (m *K3S) ExportNamespace(ctx context.Context,
+	namespace string,
+	// removes server managed fields (uid, resourceVersion, status, ...) to
+	// make the export suitable for golden files
+	// +optional
+	// +default=false
+	strip bool,
+) *dagger.Directory {
+	dir := m.kubectlContainer(ctx).
+		WithExec([]string{"sh", "-c", fmt.Sprintf(`
+set -e
+mkdir -p /tmp/export && cd /tmp/export
+for type in $(kubectl api-resources --namespaced --verbs=list -o name | grep -v '^events'); do
+  for res in $(kubectl get "$type" -n %[1]s -o name); do
+    mkdir -p "$(dirname "$res")"
+    kubectl get "$res" -n %[1]s -o yaml > "$res.yaml"
+  done
+done
+`, namespace)}).
+		Directory("/tmp/export")
+	if strip {
+		dir = dag.Container().
+			From("mikefarah/yq").
+			WithDirectory("/workdir", dir, dagger.ContainerWithDirectoryOpts{Owner: "yq"}).
+			WithExec([]string{"sh", "-c", `find . -name '*.yaml' -exec yq -i 'del(.metadata.uid, .metadata.resourceVersion, .metadata.generation, .metadata.creationTimestamp, .metadata.managedFields, .status)' {} +`}).
+			Directory("/workdir")
+	}
+	return dir
+}
+
+// rolls back the given deployment to its previous revision, or to toRevision
+// when set
+func (m *K3S) RolloutUndo(ctx context.Context,
+	namespace string,
+	deployment string,
+	// +optional
+	toRevision int,
+) *dagger.Container {
+	args := fmt.Sprintf("rollout undo deployment/%s -n %s", deployment, namespace)
+	if toRevision > 0 {
+		args += fmt.Sprintf(" --to-revision=%d", toRevision)
+	}
+	return m.Kubectl(ctx, args)
+}
+
+// returns the number of ready replicas of the given workload, e.g. a deployment
+// or statefulset
+func (m *K3S) ReadyReplicas(ctx context.Context,
+	kind string,
+	name string,
+	// +optional
+	namespace string,
+) (int, error) {
+	var res struct {
+		Status struct {
+			Replicas      *int `json:"replicas"`
+			ReadyReplicas *int `json:"readyReplicas"`
+		} `json:"status"`
+	}
+	if err := m.kubectlJSON(ctx, fmt.Sprintf("get %s %s %s", kind, name, namespaceFlag(namespace)), &res); err != nil {
+		return 0, err
+	}
+	switch {
+	case res.Status.ReadyReplicas != nil:
+		return *res.Status.ReadyReplicas, nil
+	case res.Status.Replicas != nil:
+		// readyReplicas is omitted while none are ready
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("%s %s has no replica status", kind, name)
+	}
+}
+
+// returns a kubectl proxy service exposing the API server over plain HTTP on
+// port 8001.
+//
+// For local testing only: the proxy forwards every request with the admin
+// credentials of the cluster, without any authentication.
+func (m *K3S) InsecureProxy(ctx context.Context) *dagger.Service {
+	return m.kubectlContainer(ctx).
+		WithExposedPort(8001).
+		AsService(dagger.ContainerAsServiceOpts{
+			Args: []string{"kubectl", "proxy", "--address=0.0.0.0", "--port=8001", "--accept-hosts=.*"},
+		})
+}
+
+// installs the Kubernetes Dashboard helm chart in the kubernetes-dashboard
+// namespace along with an admin-user service account bound to cluster-admin,
+// and waits for it to be ready. See DashboardToken to log in.
+func (m *K3S) WithDashboard(ctx context.Context) (*K3S, error) {
+	_, err := m.helmContainer(ctx).
+		WithExec([]string{
+			"helm", "upgrade", "--install", "kubernetes-dashboard", "kubernetes-dashboard",
+			"--repo", "https://kubernetes.github.io/dashboard/",
+			"--namespace", "kubernetes-dashboard", "--create-namespace", "--wait",
+		}).
+		Sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = m.RunScript(ctx, `set -e
+kubectl create serviceaccount admin-user -n kubernetes-dashboard --dry-run=client -o yaml | kubectl apply -f -
+kubectl create clusterrolebinding dashboard-admin-user --clusterrole=cluster-admin --serviceaccount=kubernetes-dashboard:admin-user --dry-run=client -o yaml | kubectl apply -f -
+`).Sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// returns a bearer token of the dashboard admin-user to log in to the
+// Kubernetes Dashboard installed by WithDashboard
+func (m *K3S) DashboardToken(ctx context.Context) (*dagger.Secret, error) {
+	return m.ServiceAccountToken(ctx, "kubernetes-dashboard", "admin-user")
+}
+
+// returns whether the given image is present in the containerd image store of
+// any node, e.g. after importing it.
+//
+// The server runs as a service that can't be exec'd into, so instead of
+// `k3s ctr images ls` this checks the images the kubelets report in the node
+// status. Server lifts the kubelet's default limit of 50 images for that, nodes
+// joined from outside of Dagger need node-status-max-images=-1 as well.
+func (m *K3S) HasImage(ctx context.Context, ref string) (bool, error) {
+	out, err := m.Kubectl(ctx, `get nodes -o jsonpath='{range .items[*].status.images[*]}{range .names[*]}{@}{"\n"}{end}{end}'`).Stdout(ctx)
+	if err != nil {
+		return false, err
+	}
+	ref = normalizeImageRef(ref)
+	for _, name := range strings.Fields(out) {
+		if name == ref {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// returns a bearer token for the given service account
+func (m *K3S) ServiceAccountToken(ctx context.Context, namespace, name string) (*dagger.Secret, error) {
+	ctr, err := m.kubectlContainer(ctx).
+		// written to a file so the token doesn't show up in the logs.
+		WithExec([]string{"sh", "-c", fmt.Sprintf("kubectl create token %s -n %s > /tmp/token", name, namespace)}, dagger.ContainerWithExecOpts{
+			Expect: dagger.ReturnTypeAny,
+		}).
+		Sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := newKubectlResult(ctx, ctr)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case res.ExitCode == 0:
+	case strings.Contains(res.Stderr, "(NotFound)"):
+		return nil, fmt.Errorf("service account %s/%s not found", namespace, name)
+	default:
+		return nil, fmt.Errorf("creating token for service account %s/%s: %s", namespace, name, strings.TrimSpace(res.Stderr))
+	}
+	token, err := ctr.File("/tmp/token").Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dag.SetSecret(fmt.Sprintf("k3s_token_%s_%s_%s", m.Name, namespace, name), strings.TrimSpace(token)), nil
+}
+
+// applies a NetworkPolicy manifest. Policies are enforced by the k3s embedded
+// network policy controller, which requires the default flannel CNI; clusters
+// started with --flannel-backend=none or --disable-network-policy don't
+// enforce them.
+func (m *K3S) ApplyNetworkPolicy(ctx context.Context,
+	manifest *dagger.File,
+	// +optional
+	namespace string,
+	// validates without persisting anything: server runs the admission
+	// chain and schema validation, client only checks the manifests locally
+	// +optional
+	dryRun string,
+) *dagger.Container {
+	return m.kubectlContainer(ctx).
+		WithFile("/tmp/networkpolicy.yaml", manifest).
+		WithExec([]string{"sh", "-c", "kubectl apply -f /tmp/networkpolicy.yaml " + namespaceFlag(namespace) + dryRunFlag(dryRun)})
+}
+
+// returns whether a throwaway pod with the given labels in the given namespace
+// gets an HTTP response from url, to check the effect of network policies.
+// Traffic through servicelb load balancer addresses isn't subject to the pod
+// selectors of the policies, so prefer service or pod addresses.
+func (m *K3S) CanReach(ctx context.Context,
+	namespace string,
+	url string,
+	// labels of the client pod, e.g. app=frontend,tier=web
+	// +optional
+	labels string,
+	// connection timeout in seconds
+	// +optional
+	// +default=5
+	timeout int,
+) (bool, error) {
+	args := fmt.Sprintf("run reach-%d -n %s --image=curlimages/curl --restart=Never --rm -i --quiet", time.Now().UnixNano(), namespace)
+	if labels != "" {
+		args += " --labels=" + shellQuote(labels)
+	}
+	script := fmt.Sprintf(`curl -s -o /dev/null -m %d %s; echo "curl-exit=$?"`, timeout, shellQuote(url))
+	res, err := m.KubectlResult(ctx, args+" --command -- sh -c "+shellQuote(script))
+	if err != nil {
+		return false, err
+	}
+	_, code, found := strings.Cut(res.Stdout, "curl-exit=")
+	if !found {
+		return false, fmt.Errorf("running client pod: %s", strings.TrimSpace(res.Stderr))
+	}
+	return strings.TrimSpace(code) == "0", nil
+}
+
+// returns the names of all namespaces
+func (m *K3S) Namespaces(ctx context.Context) ([]string, error) {
+	out, err := m.Kubectl(ctx, "get namespaces -o name").Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var namespaces []string
+	for _, line := range strings.Fields(out) {
+		namespaces = append(namespaces, strings.TrimPrefix(line, "namespace/"))
+	}
+	return namespaces, nil
+}
+
+// creates a deployment running the given image
+func (m *K3S) CreateDeployment(ctx context.Context,
+	namespace string,
+	name string,
+	image string,
+	// +optional
+	// +default=1
+	replicas int,
+	// container port of the pods
+	// +optional
+	port int,
+	// exposes the port through a ClusterIP service named after the
+	// deployment, requires port
+	// +optional
+	// +default=false
+	expose bool,
+) (*dagger.Container, error) {
+	if expose && port <= 0 {
+		return nil, fmt.Errorf("exposing deployment %s/%s requires a port", namespace, name)
+	}
+	args := fmt.Sprintf("create deployment %s -n %s --image=%s --replicas=%d", name, namespace, shellQuote(image), replicas)
+	if port > 0 {
+		args += fmt.Sprintf(" --port=%d", port)
+	}
+	ctr := m.Kubectl(ctx, args)
+	if expose {
+		ctr = ctr.WithExec([]string{"sh", "-c", fmt.Sprintf("kubectl expose deployment %s -n %s --port=%d", name, namespace, port)})
+	}
+	return ctr, nil
+}
+
+// waits until both the given CRD is established and the rollout of the
+// operator deployment reconciling it is complete, before CRs get applied
+func (m *K3S) WaitForOperator(ctx context.Context,
+	namespace string,
+	deployment string,
+	crdName string,
+	// timeout in seconds, applied to each wait
+	// +optional
+	// +default=120
+	timeout int,
+) error {
+	crdErr := m.WaitFor(ctx, "crd/"+crdName, "Established", "", timeout)
+	res, err := m.KubectlResult(ctx, fmt.Sprintf("rollout status deployment/%s -n %s --timeout=%ds", deployment, namespace, timeout))
+	if err != nil {
+		return err
+	}
+	var rolloutErr error
+	if res.ExitCode != 0 {
+		rolloutErr = fmt.Errorf("deployment %s/%s not rolled out within %ds: %s", namespace, deployment, timeout, strings.TrimSpace(res.Stderr))
+	}
+	if err := errors.Join(crdErr, rolloutErr); err != nil {
+		return fmt.Errorf("operator %s/%s not ready: %w", namespace, deployment, err)
+	}
+	return nil
+}
+
+// returns the logs of every node of the cluster, one <role>.log file per node.
+// The cluster currently consists of the server node only, whose logs are
+// written to server.log.
+func (m *K3S) AllLogs(ctx context.Context) *dagger.Directory {
+	return dag.Container().
+		From("alpine").
+		WithEnvVariable("CACHE", time.Now().String()).
+		WithMountedCache("/cache/logs", m.LogCache).
+		WithExec([]string{"sh", "-c", "mkdir -p /logs && cp /cache/logs/*.log /logs/"}).
+		Directory("/logs")
+}
+
+// runs a Job from the given image and command, waits for it to finish and
+// returns its logs. The Job is deleted afterwards. When the Job fails or times
+// out its logs are returned along with the error.
+func (m *K3S) RunJob(ctx context.Context,
+	namespace string,
+	name string,
+	image string,
+	// +optional
+	command []string,
+	// timeout in seconds
+	// +optional
+	// +default=300
+	timeout int,
+) (string, error) {
+	create := fmt.Sprintf("kubectl create job %s -n %s --image=%s", name, namespace, shellQuote(image))
+	if len(command) > 0 {
+		create += " --"
+		for _, arg := range command {
+			create += " " + shellQuote(arg)
+		}
+	}
+	res, err := m.scriptResult(ctx, fmt.Sprintf(`
+%[1]s >&2 || exit 3
+end=$(( $(date +%%s) + %[4]d ))
+result=2
+while [ "$(date +%%s)" -lt "$end" ]; do
+  conditions=$(kubectl get job %[2]s -n %[3]s -o jsonpath='{.status.conditions[?(@.status=="True")].type}')
+  case " $conditions " in
+    *" Complete "*) result=0; break ;;
+    *" Failed "*) result=1; break ;;
+  esac
+  sleep 1
+done
+kubectl logs job/%[2]s -n %[3]s --all-containers
+kubectl delete job %[2]s -n %[3]s --wait=false >&2
+exit $result
+`, create, name, namespace, timeout))
+	if err != nil {
+		return "", err
+	}
+	switch res.ExitCode {
+	case 0:
+		return res.Stdout, nil
+	case 1:
+		return res.Stdout, fmt.Errorf("job %s/%s failed", namespace, name)
+	case 2:
+		return res.Stdout, fmt.Errorf("job %s/%s did not finish within %ds", namespace, name, timeout)
+	default:
+		return res.Stdout, fmt.Errorf("running job %s/%s: %s", namespace, name, strings.TrimSpace(res.Stderr))
+	}
+}
+
+// returns the CA certificate the API server certificate is signed with
+func (m *K3S) CACertificate(ctx context.Context) (*dagger.File, error) {
+	// decoded from the kubeconfig, which is tied to the current server,
+	// unlike the data dir that may still hold the previous run's CA.
+	ctr, err := dag.Container().
+		From("alpine").
+		WithFile("/k3s.yaml", m.kubeconfig(ctx)).
+		WithExec([]string{"sh", "-c", `awk '/certificate-authority-data:/ {print $2; exit}' /k3s.yaml | base64 -d > /server-ca.crt && [ -s /server-ca.crt ]`}).
+		Sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ctr.File("/server-ca.crt"), nil
+}
+
+// returns whether the given service has at least one ready endpoint, i.e. is
+// backed by a ready pod
+func (m *K3S) HasEndpoints(ctx context.Context, namespace, service string) (bool, error) {
+	exists, err := m.Exists(ctx, "service", service, namespace)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, fmt.Errorf("service %s/%s not found", namespace, service)
+	}
+	var endpointSlices struct {
+		Items []struct {
+			Endpoints []struct {
+				Conditions struct {
+					Ready *bool `json:"ready"`
+				} `json:"conditions"`
+			} `json:"endpoints"`
+		} `json:"items"`
+	}
+	if err := m.kubectlJSON(ctx, fmt.Sprintf("get endpointslices -n %s -l kubernetes.io/service-name=%s", namespace, service), &endpointSlices); err != nil {
+		return false, err
+	}
+	for _, slice := range endpointSlices.Items {
+		for _, endpoint := range slice.Endpoints {
+			// a missing ready condition is to be interpreted as ready
+			if ready := endpoint.Conditions.Ready; ready == nil || *ready {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// deletes the given namespace and waits until it is gone. Namespaces stuck in
+// Terminating past the timeout return an error listing their finalizers.
+func (m *K3S) DeleteNamespace(ctx context.Context,
+	name string,
+	// timeout in seconds
+	// +optional
+	// +default=120
+	timeout int,
+) error {
+	res, err := m.scriptResult(ctx, fmt.Sprintf(`
+kubectl delete namespace %[1]s --wait=false --ignore-not-found >&2 || exit 3
+end=$(( $(date +%%s) + %[2]d ))
+while [ "$(date +%%s)" -lt "$end" ]; do
+  [ -z "$(kubectl get namespace %[1]s --ignore-not-found -o name)" ] && exit 0
+  sleep 1
+done
+kubectl get namespace %[1]s -o jsonpath='{.spec.finalizers} {.metadata.finalizers}'
+exit 2
+`, name, timeout))
+	if err != nil {
+		return err
+	}
+	switch res.ExitCode {
+	case 0:
+		return nil
+	case 2:
+		return fmt.Errorf("namespace %s not deleted within %ds, finalizers: %s", name, timeout, strings.TrimSpace(res.Stdout))
+	default:
+		return fmt.Errorf("deleting namespace %s: %s", name, strings.TrimSpace(res.Stderr))
+	}
+}
+
+// runs kubectl on the target k3s cluster with JSON output (-o json) and returns
+// the raw JSON document
+func (m *K3S) KubectlJSON(ctx context.Context, args string) (string, error) {
+	return m.Kubectl(ctx, args+" -o json").Stdout(ctx)
+}
+
+// follows the logs of the given pod for the given number of seconds and returns
+// what was collected. Reaching the deadline is not an error.
+func (m *K3S) FollowPodLogs(ctx context.Context,
+	namespace string,
+	pod string,
+	// +optional
+	// +default=30
+	seconds int,
+) (string, error) {
+	res, err := m.scriptResult(ctx, fmt.Sprintf(`
+timeout %d kubectl logs -f %s -n %s
+code=$?
+# timeout exits with 124 once the deadline is reached
+[ "$code" -eq 124 ] && exit 0
+exit "$code"
+`, seconds, pod, namespace))
+	if err != nil {
+		return "", err
+	}
+	if res.ExitCode != 0 {
+		return res.Stdout, fmt.Errorf("following logs of pod %s/%s: %s", namespace, pod, strings.TrimSpace(res.Stderr))
+	}
+	return res.Stdout, nil
+}
+
+// labels the given namespace to enforce the privileged Pod Security Standard,
+// allowing privileged pods in it. k3s enforces no standard by default, but
+// clusters configured with a stricter PodSecurity admission default reject
+// privileged pods in unlabeled namespaces.
+func (m *K3S) AllowPrivilegedInNamespace(ctx context.Context, namespace string) *dagger.Container {
+	return m.Kubectl(ctx, fmt.Sprintf("label namespace %s pod-security.kubernetes.io/enforce=privileged --overwrite", namespace))
+}
+
+// applies the manifests of the given directory, recursively
+func (m *K3S) ApplyManifests(ctx context.Context,
+	dir *dagger.Directory,
+	// namespace for the namespaced resources that don't set one. kubectl
+	// refuses to apply resources that hardcode a different namespace.
+	// +optional
+	namespace string,
+	// validates without persisting anything: server runs the admission
+	// chain and schema validation, client only checks the manifests locally
+	// +optional
+	dryRun string,
+) *dagger.Container {
+	return m.kubectlContainer(ctx).
+		WithDirectory("/tmp/manifests", dir).
+		WithExec([]string{"sh", "-c", "kubectl apply -R -f /tmp/manifests " + namespaceFlag(namespace) + dryRunFlag(dryRun)})
+}
+
+// applies the manifests of the given directory like ApplyManifests and returns
+// the created or configured resources, e.g. deployment.apps/nginx
+func (m *K3S) ApplyAndList(ctx context.Context,
+	dir *dagger.Directory,
+	// namespace for the namespaced resources that don't set one. kubectl
+	// refuses to apply resources that hardcode a different namespace.
+	// +optional
+	namespace string,
+	// validates without persisting anything: server runs the admission
+	// chain and schema validation, client only checks the manifests locally
+	// +optional
+	dryRun string,
+) ([]string, error) {
+	out, err := m.kubectlContainer(ctx).
+		WithDirectory("/tmp/manifests", dir).
+		WithExec([]string{"sh", "-c", "kubectl apply -R -f /tmp/manifests -o name " + namespaceFlag(namespace) + dryRunFlag(dryRun)}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+// waits until the pods of the given namespace, optionally filtered by a label
+// selector, are ready. Fails as soon as a pod can't pull its image instead of
+// waiting for the timeout.
+func (m *K3S) WaitForPodsReady(ctx context.Context,
+	// +optional
+	namespace string,
+	// label selector, e.g. app=nginx
+	// +optional
+	selector string,
+	// timeout in seconds
+	// +optional
+	// +default=120
+	timeout int,
+) error {
+	args := "get pods " + namespaceFlag(namespace)
+	if selector != "" {
+		args += " -l " + shellQuote(selector)
+	}
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	for {
+		var pods struct {
+			Items []struct {
+				Metadata struct {
+					Name string `json:"name"`
+				} `json:"metadata"`
+				Status struct {
+					Phase      string `json:"phase"`
+					Conditions []struct {
+						Type   string `json:"type"`
+						Status string `json:"status"`
+					} `json:"conditions"`
+					InitContainerStatuses []containerStatus `json:"initContainerStatuses"`
+					ContainerStatuses     []containerStatus `json:"containerStatuses"`
+				} `json:"status"`
+			} `json:"items"`
+		}
+		if err := m.kubectlJSON(ctx, args, &pods); err != nil {
+			return err
+		}
+
+		var pending []string
+		for _, pod := range pods.Items {
+			for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+				switch waiting := status.State.Waiting; {
+				case waiting == nil:
+				case waiting.Reason == "ErrImagePull", waiting.Reason == "ImagePullBackOff", waiting.Reason == "InvalidImageName":
+					return fmt.Errorf("pod %s can't pull image %s: %s: %s", pod.Metadata.Name, status.Image, waiting.Reason, waiting.Message)
+				}
+			}
+			ready := pod.Status.Phase == "Succeeded"
+			for _, cond := range pod.Status.Conditions {
+				if cond.Type == "Ready" && cond.Status == "True" {
+					ready = true
+				}
+			}
+			if !ready {
+				pending = append(pending, pod.Metadata.Name)
+			}
+		}
+		if len(pods.Items) > 0 && len(pending) == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			if len(pods.Items) == 0 {
+				return fmt.Errorf("no pods found within %ds", timeout)
+			}
+			return fmt.Errorf("pods not ready within %ds: %s", timeout, strings.Join(pending, ", "))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// applies a LimitRange named default-limits to the given namespace, setting the
+// resources of containers that don't specify their own. Resources are given as
+// resource=quantity pairs, e.g. cpu=500m or memory=256Mi.
+func (m *K3S) WithLimitRange(ctx context.Context,
+	namespace string,
+	// default limits
+	defaults []string,
+	// default requests, kubernetes uses the limits when unset
+	// +optional
+	defaultRequests []string,
+) (*dagger.Container, error) {
+	limits, err := quantitiesYAML(defaults, "      ")
+	if err != nil {
+		return nil, err
+	}
+	manifest := fmt.Sprintf(`apiVersion: v1
+kind: LimitRange
+metadata:
+  name: default-limits
+  namespace: %s
+spec:
+  limits:
+  - type: Container
+    default:
+%s`, namespace, limits)
+	if len(defaultRequests) > 0 {
+		requests, err := quantitiesYAML(defaultRequests, "      ")
+		if err != nil {
+			return nil, err
+		}
+		manifest += "    defaultRequest:\n" + requests
+	}
+	return m.applyManifest(ctx, manifest), nil
+}
+
+// applies a ResourceQuota named quota to the given namespace. The hard limits
+// are given as resource=quantity pairs, e.g. requests.cpu=2 or pods=10.
+func (m *K3S) WithResourceQuota(ctx context.Context, namespace string, hard []string) (*dagger.Container, error) {
+	limits, err := quantitiesYAML(hard, "    ")
+	if err != nil {
+		return nil, err
+	}
+	return m.applyManifest(ctx, fmt.Sprintf(`apiVersion: v1
+kind: ResourceQuota
+metadata:
+  name: quota
+  namespace: %s
+spec:
+  hard:
+%s`, namespace, limits)), nil
+}
+
+// returns the number of resources of the given kind in the given namespace, or
+// in all namespaces when empty
+func (m *K3S) ResourceCount(ctx context.Context,
+	kind string,
+	// +optional
+	namespace string,
+) (int, error) {
+	scope := "--all-namespaces"
+	if namespace != "" {
+		scope = "-n " + namespace
+	}
+	out, err := m.Kubectl(ctx, fmt.Sprintf("get %s %s -o name", kind, scope)).Stdout(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return len(strings.Fields(out)), nil
+}
+
+// waits until the given pod reaches the given phase (Pending, Running,
+// Succeeded, Failed or Unknown). Fails early when the pod ends up in another
+// terminal phase.
+func (m *K3S) WaitForPodPhase(ctx context.Context,
+	namespace string,
+	pod string,
+	phase string,
+	// timeout in seconds
+	// +optional
+	// +default=120
+	timeout int,
+) error {
+	switch phase {
+	case "Pending", "Running", "Succeeded", "Failed", "Unknown":
+	default:
+		return fmt.Errorf("unknown pod phase %q", phase)
+	}
+	res, err := m.scriptResult(ctx, fmt.Sprintf(`
+end=$(( $(date +%%s) + %[4]d ))
+while :; do
+  current=$(kubectl get pod %[1]s -n %[2]s -o jsonpath='{.status.phase}')
+  [ "$current" = %[3]s ] && exit 0
+  case "$current" in Succeeded|Failed) printf '%%s' "$current"; exit 1 ;; esac
+  [ "$(date +%%s)" -ge "$end" ] && printf '%%s' "$current" && exit 2
+  sleep 1
+done
+`, pod, namespace, phase, timeout))
+	if err != nil {
+		return err
+	}
+	switch res.ExitCode {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("pod %s/%s ended up %s instead of %s", namespace, pod, res.Stdout, phase)
+	case 2:
+		return fmt.Errorf("pod %s/%s not %s within %ds, last phase: %s", namespace, pod, phase, timeout, res.Stdout)
+	default:
+		return fmt.Errorf("waiting for pod %s/%s: %s", namespace, pod, strings.TrimSpace(res.Stderr))
+	}
+}
+
+// waits until the apiserver reports itself ready on /readyz, which is a
+// finer grained check than node readiness. On timeout the verbose output is
+// returned so the failing checks can be told apart.
+func (m *K3S) ApiReady(ctx context.Context,
+	// timeout in seconds
+	// +optional
+	// +default=120
+	timeout int,
+) error {
+	end := time.Now().Add(time.Duration(timeout) * time.Second)
+	// like in Start, the cluster's own kubeconfig whose wait is bounded by
+	// the timeout as well.
+	config := m.Config(ctx, false, "", false, "", max(timeout, 1), "")
+	res, err := m.scriptResultWithin(ctx, config, fmt.Sprintf(`
+end=%d
+until out=$(kubectl get --raw '/readyz?verbose' 2>&1); do
+  [ "$(date +%%s)" -ge "$end" ] && printf '%%s' "$out" && exit 1
+  sleep 1
+done
+`, end.Unix()))
+	if err != nil {
+		return fmt.Errorf("apiserver not ready within %ds: %w", timeout, err)
+	}
+	if res.ExitCode != 0 {
+		return fmt.Errorf("apiserver not ready within %ds:\n%s", timeout, strings.TrimSpace(res.Stdout))
+	}
+	return nil
+}
+
+// runs the given kubectl commands (without the kubectl prefix) in order,
+// stopping at the first one that fails
+func (m *K3S) KubectlBatch(ctx context.Context, commands []string) error {
+	for i, args := range commands {
+		res, err := m.KubectlResult(ctx, args)
+		if err != nil {
+			return err
+		}
+		if res.ExitCode != 0 {
+			return fmt.Errorf("command %d (kubectl %s) failed with exit code %d: %s",
+				i+1, args, res.ExitCode, strings.TrimSpace(res.Stderr))
+		}
+	}
+	return nil
+}
+
+// returns a kubeconfig that authenticates as the given service account instead
+// of the cluster admin, to test clients with the permissions their RBAC rules
+// grant. Like the token it embeds, it expires after an hour by default.
+//
+// The token, server and CA all come from the context the helpers use, see
+// WithKubectlContext.
+func (m *K3S) KubeconfigForServiceAccount(ctx context.Context, namespace, sa string) (*dagger.Secret, error) {
+	token, err := m.ServiceAccountToken(ctx, namespace, sa)
+	if err != nil {
+		return nil, err
+	}
+	user := namespace + ":" + sa
+	config, err := m.kubectlContainer(ctx).
+		WithMountedSecret("/tmp/token", token, dagger.ContainerWithMountedSecretOpts{Owner: "1001"}).
+		WithExec([]string{"sh", "-c", fmt.Sprintf(`set -e
+server=$(kubectl config view --minify -o jsonpath='{.clusters[0].cluster.server}')
+kubectl config view --minify --raw -o jsonpath='{.clusters[0].cluster.certificate-authority-data}' | base64 -d > /tmp/ca.crt
+[ -s /tmp/ca.crt ] || { echo "no CA in the kubeconfig of the selected context" >&2; exit 1; }
+export KUBECONFIG=/tmp/sa.yaml
+kubectl config set-cluster k3s --server="$server" --certificate-authority=/tmp/ca.crt --embed-certs >/dev/null
+kubectl config set-credentials %[1]s --token="$(cat /tmp/token)" >/dev/null
+kubectl config set-context %[1]s --cluster=k3s --user=%[1]s --namespace=%[2]s >/dev/null
+kubectl config use-context %[1]s >/dev/null
+`, shellQuote(user), shellQuote(namespace))}).
+		File("/tmp/sa.yaml").
+		Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dag.SetSecret(fmt.Sprintf("k3s_kubeconfig_%s_%s_%s", m.Name, namespace, sa), config), nil
+}
+
+// returns the output of `k3s secrets-encrypt status`, which reports whether
+// secrets are encrypted at rest and the active encryption key, e.g.
+//
+//	Encryption Status: Enabled
+//	Current Rotation Stage: start
+//	Server Encryption Hashes: All hashes match
+func (m *K3S) SecretsEncryptionStatus(ctx context.Context) (string, error) {
+	ctr, err := dag.Container().
+		From(m.Image).
+		WithoutEntrypoint().
+		WithEnvVariable("CACHE", time.Now().String()).
+		WithMountedCache("/etc/rancher/k3s", m.ConfigCache).
+		WithMountedCache("/var/lib/rancher", m.StateCache).
+		WithExec([]string{"sh", "-c", `while [ ! -f /var/lib/rancher/k3s/server/token ] || [ ! -f /etc/rancher/k3s/k3s.yaml ]; do echo "token not ready, is server started?. waiting.. " && sleep 0.5; done`}).
+		WithExec([]string{"sh", "-c", `k3s secrets-encrypt status --data-dir /var/lib/rancher/k3s --server "$(awk '/server:/ {print $2}' /etc/rancher/k3s/k3s.yaml)" --token "$(cat /var/lib/rancher/k3s/server/token)"`}, dagger.ContainerWithExecOpts{
+			Expect: dagger.ReturnTypeAny,
+		}).
+		Sync(ctx)
+	if err != nil {
+		return "", err
+	}
+	res, err := newKubectlResult(ctx, ctr)
+	if err != nil {
+		return "", err
+	}
+	if res.ExitCode != 0 {
+		return "", fmt.Errorf("getting secrets encryption status: %s", strings.TrimSpace(res.Stderr))
+	}
+	return strings.TrimSpace(res.Stdout), nil
+}
+
+// returns the sorted, deduplicated images of the containers of the running
+// pods in all namespaces, as written in the pod specs
+func (m *K3S) RunningImages(ctx context.Context) ([]string, error) {
+	out, err := m.Kubectl(ctx, `get pods -A --field-selector=status.phase=Running -o jsonpath='{.items[*].spec.containers[*].image}'`).Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	images := strings.Fields(out)
+	slices.Sort(images)
+	return slices.Compact(images), nil
+}
+
+// runs the Kubernetes conformance tests with Sonobuoy and returns its results
+// tarball, to be inspected with `sonobuoy results`. The quick mode runs a
+// single test to check the cluster works, non-disruptive-conformance skips
+// the tests that disrupt other workloads and certified-conformance runs the
+// full suite, which takes over an hour.
+func (m *K3S) Conformance(ctx context.Context,
+	// +optional
+	// +default="quick"
+	mode string,
+	// +optional
+	// +default="v0.57.3"
+	version string,
+) (*dagger.File, error) {
+	switch mode {
+	case "quick", "non-disruptive-conformance", "certified-conformance":
+	default:
+		return nil, fmt.Errorf("unknown conformance mode %q", mode)
+	}
+	ctr, err := m.kubectlContainer(ctx).
+		WithFile("/usr/local/bin/sonobuoy", dag.Container().From("sonobuoy/sonobuoy:"+version).File("/sonobuoy")).
+		WithExec([]string{"sh", "-c", fmt.Sprintf(`set -e
+sonobuoy run --mode %s --wait
+mkdir -p /tmp/results
+sonobuoy retrieve /tmp/results --filename results.tar.gz
+sonobuoy delete --wait
+`, mode)}, dagger.ContainerWithExecOpts{
+			Expect: dagger.ReturnTypeAny,
+		}).
+		Sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := newKubectlResult(ctx, ctr)
+	if err != nil {
+		return nil, err
+	}
+	if res.ExitCode != 0 {
+		return nil, fmt.Errorf("running sonobuoy in %s mode: %s", mode, strings.TrimSpace(res.Stderr))
+	}
+	return ctr.File("/tmp/results/results.tar.gz"), nil
+}
+
+// parses a kubectl top quantity such as "12m" or "34Mi" in the given unit
+func parseQuantity(quantity, unit string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSuffix(quantity, unit))
+	if err != nil {
+		return 0, fmt.Errorf("invalid quantity %q: %w", quantity, err)
+	}
+	return n, nil
+}
+
+// collects the output of the last exec of the given container
+func newKubectlResult(ctx context.Context, ctr *dagger.Container) (*KubectlResult, error) {
+	code, err := ctr.ExitCode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := ctr.Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := ctr.Stderr(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &KubectlResult{Stdout: stdout, Stderr: stderr, ExitCode: code}, nil
+}
+
+// returns the given kubeconfig after checking that kubectl can reach the
+// cluster with it
+func validateConfig(config *dagger.File) *dagger.File {
+	return dag.Container().
+		From("bitnami/kubectl").
+		WithoutEntrypoint().
+		WithEnvVariable("CACHE", time.Now().String()).
+		WithFile("/.kube/config", config, dagger.ContainerWithFileOpts{Permissions: 1001}).
+		WithUser("1001").
+		WithExec([]string{"kubectl", "cluster-info"}).
+		File("/.kube/config")
+}
+
+// returns the kubectl namespace flag, or an empty string for the default namespace
+func namespaceFlag(namespace string) string {
+	if namespace == "" {
+		return ""
+	}
+	return "-n " + namespace
+}
+
+// quotes the given string for use as a single shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// returns the kubectl flags to impersonate the given user and groups
+func impersonationFlags(user string, groups []string) string {
+	flags := "--as=" + shellQuote(user)
+	for _, group := range groups {
+		flags += " --as-group=" + shellQuote(group)
+	}
+	return flags
+}
+
+// expands an image reference to the fully qualified form containerd uses,
+// e.g. alpine becomes docker.io/library/alpine:latest
+func normalizeImageRef(ref string) string {
+	name, digest, hasDigest := strings.Cut(ref, "@")
+	parts := strings.Split(name, "/")
+	if len(parts) == 1 || !strings.ContainsAny(parts[0], ".:") && parts[0] != "localhost" {
+		if len(parts) == 1 {
+			parts = append([]string{"library"}, parts...)
+		}
+		parts = append([]string{"docker.io"}, parts...)
+	}
+	name = strings.Join(parts, "/")
+	if hasDigest {
+		return name + "@" + digest
+	}
+	if !strings.Contains(parts[len(parts)-1], ":") {
+		name += ":latest"
+	}
+	return name
+}
+
+// runs kubectl with JSON output and decodes the result into v
+func (m *K3S) kubectlJSON(ctx context.Context, args string, v any) error {
+	out, err := m.KubectlJSON(ctx, args)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(out), v); err != nil {
+		return fmt.Errorf("parsing output of kubectl %s: %w", args, err)
+	}
+	return nil
+}
+
+// applies the given manifest
+func (m *K3S) applyManifest(ctx context.Context, manifest string) *dagger.Container {
+	return m.kubectlContainer(ctx).
+		WithNewFile("/tmp/manifest.yaml", manifest).
+		WithExec([]string{"sh", "-c", "kubectl apply -f /tmp/manifest.yaml"})
+}
+
+// renders resource=quantity pairs as YAML mapping entries with the given
+// indentation, sorted by resource
+func quantitiesYAML(pairs []string, indent string) (string, error) {
+	if len(pairs) == 0 {
+		return "", fmt.Errorf("no resource quantities given")
+	}
+	pairs = slices.Sorted(slices.Values(pairs))
+	var b strings.Builder
+	for _, pair := range pairs {
+		resource, quantity, ok := strings.Cut(pair, "=")
+		if !ok || resource == "" || quantity == "" {
+			return "", fmt.Errorf("invalid resource quantity %q, expected resource=quantity", pair)
+		}
+		fmt.Fprintf(&b, "%s%s: %q\n", indent, resource, quantity)
+	}
+	return b.String(), nil
+}
+
+// returns the kubectl --dry-run flag for the given mode (server or client),
+// or an empty string to apply for real. kubectl rejects unknown modes.
+func dryRunFlag(mode string) string {
+	if mode == "" {
+		return ""
+	}
+	return " --dry-run=" + shellQuote(mode)
+}
+
+// returns the IP families, in order, of a comma separated CIDR list holding
+// at most one range per family
+func cidrFamilies(list string) ([]string, error) {
+	var families []string
+	for _, cidr := range strings.Split(list, ",") {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		family := "ipv6"
+		if ip.To4() != nil {
+			family = "ipv4"
+		}
+		if slices.Contains(families, family) {
+			return nil, fmt.Errorf("more than one %s range in %q", family, list)
+		}
+		families = append(families, family)
+	}
+	return families, nil
 }
 
 func getFreePort() (int, error) {